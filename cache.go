@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const audioCacheTempPrefix = ".tmp-"
+
+var outputContentTypes = map[string]string{
+	"wav":  "audio/wav",
+	"mp3":  "audio/mpeg",
+	"opus": "audio/ogg",
+	"flac": "audio/flac",
+	// G.711 at 8 kHz, raw or in a WAV file
+	"ulaw":     "audio/basic",
+	"alaw":     "audio/x-alaw-basic",
+	"ulaw-wav": "audio/wav",
+	"alaw-wav": "audio/wav",
+}
+
+var (
+	piperVersionOnce  sync.Once
+	piperVersionValue string
+)
+
+// piperVersion identifies the piper binary so upgrading it invalidates the
+// cache. Falls back to the binary size and modification time when piper
+// can't report its version.
+func piperVersion() string {
+	piperVersionOnce.Do(func() {
+		out, err := exec.Command(PIPER_BINARY, "--version").Output()
+		if err == nil {
+			piperVersionValue = strings.TrimSpace(string(out))
+			return
+		}
+		if info, err := os.Stat(PIPER_BINARY); err == nil {
+			piperVersionValue = info.ModTime().UTC().Format(time.RFC3339Nano) + "/" + strconv.FormatInt(info.Size(), 10)
+		}
+	})
+	return piperVersionValue
+}
+
+// audioCacheKey returns the cache file name for a planned request. The key
+// covers the resolved segments rather than the request, so that voice aliases
+// share entries, and the model files of their voices, so that replacing a
+// model invalidates its entries. Text is normalized so that whitespace
+// changes don't cause a miss. Downloaded files are keyed apart from streamed
+// ones, since only their WAV and FLAC headers hold the actual sizes.
+func audioCacheKey(plan ttsPlan, voices *Voices, download bool) string {
+	segments := make([]ttsSegment, len(plan.Segments))
+	models := make(map[string]map[string]File)
+	for i, segment := range plan.Segments {
+		segment.Text = strings.Join(strings.Fields(segment.Text), " ")
+		segments[i] = segment
+		if voice, ok := (*voices)[segment.Config.Voice]; ok && segment.Pause == 0 {
+			models[segment.Config.Voice] = voice.Files
+		}
+	}
+	key, _ := json.Marshal(struct {
+		Segments     []ttsSegment
+		SampleRate   int
+		OutputFormat string
+		Output       pcmFormat
+		Models       map[string]map[string]File
+		Download     bool
+		PiperVersion string
+	}{segments, plan.SampleRate, plan.OutputFormat, plan.Output, models, download, piperVersion()})
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:]) + "." + plan.OutputFormat
+}
+
+type audioCacheEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// AudioCache stores finished audio files under a directory, evicting the
+// least recently used ones once their total size exceeds maxBytes.
+type AudioCache struct {
+	mu         sync.Mutex
+	dir        string
+	maxBytes   int64
+	totalBytes int64
+	entries    map[string]*audioCacheEntry
+}
+
+func newAudioCache(dir string, maxBytes int64) (*AudioCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AudioCache{dir: dir, maxBytes: maxBytes, entries: make(map[string]*audioCacheEntry)}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), audioCacheTempPrefix) {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		a.entries[file.Name()] = &audioCacheEntry{size: info.Size(), lastUsed: info.ModTime()}
+		a.totalBytes += info.Size()
+	}
+	a.mu.Lock()
+	a.evictLocked()
+	a.mu.Unlock()
+	return a, nil
+}
+
+func initAudioCache() *AudioCache {
+	if AUDIO_CACHE_PATH == "" {
+		return nil
+	}
+	a, err := newAudioCache(AUDIO_CACHE_PATH, int64(AUDIO_CACHE_MAX_MB)*1024*1024)
+	if err != nil {
+		log.Fatalf("Failed to initialize audio cache: %v", err)
+	}
+	return a
+}
+
+func (a *AudioCache) evictLocked() {
+	if a.totalBytes <= a.maxBytes {
+		return
+	}
+	names := make([]string, 0, len(a.entries))
+	for name := range a.entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return a.entries[names[i]].lastUsed.Before(a.entries[names[j]].lastUsed)
+	})
+	for _, name := range names {
+		if a.totalBytes <= a.maxBytes {
+			return
+		}
+		if err := os.Remove(filepath.Join(a.dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to evict cached audio %s: %v", name, err)
+			continue
+		}
+		a.totalBytes -= a.entries[name].size
+		delete(a.entries, name)
+	}
+}
+
+// open returns the cached file for name and marks it as recently used.
+func (a *AudioCache) open(name string) (*os.File, bool) {
+	a.mu.Lock()
+	entry, ok := a.entries[name]
+	if ok {
+		entry.lastUsed = time.Now()
+	}
+	a.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	file, err := os.Open(filepath.Join(a.dir, name))
+	if err != nil {
+		return nil, false
+	}
+	return file, true
+}
+
+func (a *AudioCache) create() (*os.File, error) {
+	return os.CreateTemp(a.dir, audioCacheTempPrefix)
+}
+
+func (a *AudioCache) commit(tmp *os.File, name string) error {
+	info, err := tmp.Stat()
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(a.dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if previous, ok := a.entries[name]; ok {
+		a.totalBytes -= previous.size
+	}
+	a.entries[name] = &audioCacheEntry{size: info.Size(), lastUsed: time.Now()}
+	a.totalBytes += info.Size()
+	a.evictLocked()
+	return nil
+}
+
+func (a *AudioCache) discard(tmp *os.File) {
+	tmp.Close()
+	os.Remove(tmp.Name())
+}
+
+// serve writes a cached file with Content-Length and ETag, answering
+// If-None-Match and Range requests. It returns false on a cache miss.
+func (a *AudioCache) serve(c *gin.Context, name string, outputFormat string) bool {
+	file, ok := a.open(name)
+	if !ok {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	c.Header("Content-Type", outputContentTypes[outputFormat])
+	c.Header("ETag", `"`+strings.TrimSuffix(name, filepath.Ext(name))+`"`)
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime(), file)
+	return true
+}
+
+// cacheTeeWriter copies everything written to the client into a cache file.
+type cacheTeeWriter struct {
+	gin.ResponseWriter
+	file *os.File
+	err  error
+}
+
+func (w *cacheTeeWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	if w.err == nil {
+		_, w.err = w.file.Write(data[:n])
+	}
+	return n, err
+}
+
+func (w *cacheTeeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// cachedAudioStream serves a request from the cache, or streams it live with
+// streamTTSPlan while saving the audio for the next identical request.
+// Download requests are handled by piperToAudioDownload.
+func cachedAudioStream(c *gin.Context, ttsRequestInput TTSRequestInput, voices *Voices, pool *PiperPool, cache *AudioCache) {
+	if ttsRequestInput.Download {
+		piperToAudioDownload(c, ttsRequestInput, voices, pool, cache)
+		return
+	}
+	if _, ok := outputContentTypes[ttsRequestInput.OutputFormat]; cache == nil || !ok {
+		piperToAudioStream(c, ttsRequestInput, voices, pool)
+		return
+	}
+	// Planning first keeps requests for voices since deleted or disallowed
+	// from being answered from the cache
+	plan, err := planTTS(ttsRequestInput, voices)
+	if err != nil {
+		writeTTSPlanError(c, err)
+		return
+	}
+	name := audioCacheKey(plan, voices, false)
+	if cache.serve(c, name, plan.OutputFormat) {
+		return
+	}
+
+	tmp, err := cache.create()
+	if err != nil {
+		log.Printf("Failed to create audio cache file: %v", err)
+		streamTTSPlan(c, ttsRequestInput, plan, pool)
+		return
+	}
+	writer := &cacheTeeWriter{ResponseWriter: c.Writer, file: tmp}
+	c.Writer = writer
+	streamTTSPlan(c, ttsRequestInput, plan, pool)
+	c.Writer = writer.ResponseWriter
+
+	complete := writer.err == nil && writer.Status() == http.StatusOK && len(c.Errors) == 0 && c.Request.Context().Err() == nil
+	if !complete {
+		cache.discard(tmp)
+		return
+	}
+	if err := cache.commit(tmp, name); err != nil {
+		log.Printf("Failed to save audio to cache: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCachePlan(text string) ttsPlan {
+	return ttsPlan{
+		Segments:     []ttsSegment{{Config: piperConfig{Voice: "v", LengthScale: 1.0}, Text: text}},
+		SampleRate:   16000,
+		OutputFormat: "wav",
+		Output:       pcmFormat{SampleRate: 16000, Channels: 1, BitsPerSample: 16},
+	}
+}
+
+func TestAudioCacheKey_NormalizesWhitespace(t *testing.T) {
+	voices := Voices{}
+	a := audioCacheKey(testCachePlan("hello   world\n"), &voices, false)
+	b := audioCacheKey(testCachePlan(" hello world"), &voices, false)
+	if a != b {
+		t.Fatalf("expected identical keys, got %q and %q", a, b)
+	}
+}
+
+func TestAudioCacheKey_DiffersByParameters(t *testing.T) {
+	voices := Voices{}
+	base := testCachePlan("hello")
+	key := audioCacheKey(base, &voices, false)
+	variants := make([]ttsPlan, 5)
+	for i := range variants {
+		variants[i] = testCachePlan("hello")
+	}
+	variants[0].Segments[0].Config.Voice = "other"
+	variants[1].Segments[0].Config.LengthScale = 0.5
+	variants[2].OutputFormat = "mp3"
+	variants[3].Segments[0].Config.Speaker = 1
+	variants[4].Output.SampleRate = 8000
+	for _, variant := range variants {
+		if audioCacheKey(variant, &voices, false) == key {
+			t.Fatalf("expected %+v to have a different key", variant)
+		}
+	}
+}
+
+func TestAudioCacheKey_ChangesWithModel(t *testing.T) {
+	voices := Voices{"v": {Key: "v", Files: map[string]File{"v.onnx": {MD5Digest: "aaaa"}}}}
+	key := audioCacheKey(testCachePlan("hello"), &voices, false)
+	voices["v"] = Voice{Key: "v", Files: map[string]File{"v.onnx": {MD5Digest: "bbbb"}}}
+	if audioCacheKey(testCachePlan("hello"), &voices, false) == key {
+		t.Fatal("expected a new model to change the key")
+	}
+}
+
+func TestAudioCacheKey_SharedByAliases(t *testing.T) {
+	voices := Voices{"test-cache-voice": {Key: "test-cache-voice", Aliases: []string{"narrator"}}}
+	voiceRegistry.set("test-cache-voice", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	defer voiceRegistry.remove("test-cache-voice")
+
+	keys := make([]string, 0, 2)
+	for _, voice := range []string{"test-cache-voice", "narrator"} {
+		plan, err := planTTS(TTSRequestInput{Text: "hello", Voice: voice, Speed: 1.0, OutputFormat: "wav"}, &voices)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		keys = append(keys, audioCacheKey(plan, &voices, false))
+	}
+	if keys[0] != keys[1] {
+		t.Fatalf("expected aliases to share a key, got %q and %q", keys[0], keys[1])
+	}
+}
+
+// testCacheKey returns the cache key of a request, which must be valid.
+func testCacheKey(t *testing.T, input TTSRequestInput, voices *Voices) string {
+	t.Helper()
+	plan, err := planTTS(input, voices)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return audioCacheKey(plan, voices, input.Download)
+}
+
+func writeCacheEntry(t *testing.T, cache *AudioCache, name string, content string) {
+	t.Helper()
+	tmp, err := cache.create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.WriteString(content)
+	if err := cache.commit(tmp, name); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAudioCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newAudioCache(dir, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	writeCacheEntry(t, cache, "a.wav", "aaaa")
+	writeCacheEntry(t, cache, "b.wav", "bbbb")
+	cache.entries["a.wav"].lastUsed = time.Now().Add(-time.Hour)
+	cache.entries["b.wav"].lastUsed = time.Now().Add(-time.Minute)
+	writeCacheEntry(t, cache, "c.wav", "cccc")
+
+	if _, err := os.Stat(filepath.Join(dir, "a.wav")); !os.IsNotExist(err) {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+	for _, name := range []string{"b.wav", "c.wav"} {
+		if _, ok := cache.entries[name]; !ok {
+			t.Fatalf("expected %s to be kept", name)
+		}
+	}
+	if cache.totalBytes != 8 {
+		t.Fatalf("expected 8 cached bytes, got %d", cache.totalBytes)
+	}
+}
+
+func TestNewAudioCache_IndexesExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.wav"), []byte("aaaa"), 0644)
+	os.WriteFile(filepath.Join(dir, audioCacheTempPrefix+"123"), []byte("partial"), 0644)
+
+	cache, err := newAudioCache(dir, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := cache.entries["a.wav"]; !ok {
+		t.Fatal("expected existing file to be indexed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, audioCacheTempPrefix+"123")); !os.IsNotExist(err) {
+		t.Fatal("expected leftover temp file to be removed")
+	}
+}
+
+func TestCachedAudioStream_ServesHit(t *testing.T) {
+	cache, err := newAudioCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	voices := Voices{}
+	voiceRegistry.set("test-cache-voice", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	defer voiceRegistry.remove("test-cache-voice")
+	input := TTSRequestInput{Text: "hello", Voice: "test-cache-voice", Speed: 1.0, OutputFormat: "wav"}
+	name := testCacheKey(t, input, &voices)
+	writeCacheEntry(t, cache, name, "cached audio")
+
+	c, w := newTestContext("GET", "/api/tts", "")
+	cachedAudioStream(c, input, &voices, nil, cache)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w.Body.String() != "cached audio" {
+		t.Fatalf("expected cached body, got %q", w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != "12" {
+		t.Fatalf("expected Content-Length 12, got %q", w.Header().Get("Content-Length"))
+	}
+	if w.Header().Get("Content-Type") != "audio/wav" {
+		t.Fatalf("expected audio/wav, got %q", w.Header().Get("Content-Type"))
+	}
+
+	etag := w.Header().Get("ETag")
+	c, w = newTestContext("GET", "/api/tts", "")
+	c.Request.Header.Set("If-None-Match", etag)
+	cachedAudioStream(c, input, &voices, nil, cache)
+	if c.Writer.Status() != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", c.Writer.Status())
+	}
+	if w.Body.Len() != 0 {
+		t.Fatalf("expected empty body, got %q", w.Body.String())
+	}
+}
+
+func TestCachedAudioStream_StoresMiss(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+	cache, err := newAudioCache(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	voices := Voices{}
+	voiceRegistry.set("test-cache-voice", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	defer voiceRegistry.remove("test-cache-voice")
+
+	input := TTSRequestInput{Text: "hello", Voice: "test-cache-voice", Speed: 1.0, OutputFormat: "wav"}
+	c, w := newTestContext("GET", "/api/tts", "")
+	cachedAudioStream(c, input, &voices, pool, cache)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	cached, err := os.ReadFile(filepath.Join(cache.dir, testCacheKey(t, input, &voices)))
+	if err != nil {
+		t.Fatalf("expected response to be cached: %v", err)
+	}
+	if string(cached) != w.Body.String() {
+		t.Fatalf("expected cached file to match the response, got %q and %q", cached, w.Body.String())
+	}
+}
+
+func TestCachedAudioStream_DoesNotStoreErrors(t *testing.T) {
+	cache, err := newAudioCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	voices := Voices{}
+	c, w := newTestContext("GET", "/api/tts", "")
+	cachedAudioStream(c, TTSRequestInput{Text: "hello", Voice: "missing", OutputFormat: "wav"}, &voices, nil, cache)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if len(cache.entries) != 0 {
+		t.Fatalf("expected nothing cached, got %v", cache.entries)
+	}
+}
+
+func TestCachedAudioStream_DoesNotServeRemovedVoices(t *testing.T) {
+	cache, err := newAudioCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	voices := Voices{}
+	voiceRegistry.set("test-cache-voice", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	input := TTSRequestInput{Text: "hello", Voice: "test-cache-voice", Speed: 1.0, OutputFormat: "wav"}
+	writeCacheEntry(t, cache, testCacheKey(t, input, &voices), "cached audio")
+	voiceRegistry.remove("test-cache-voice")
+
+	c, w := newTestContext("GET", "/api/tts", "")
+	cachedAudioStream(c, input, &voices, nil, cache)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %q", w.Code, w.Body.String())
+	}
+}
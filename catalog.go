@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VoiceCatalog holds the voices.json catalog, which can be replaced at
+// runtime, along with the custom voices uploaded to VOICES_PATH. Handlers work
+// on the snapshot returned by get, which is never modified.
+type VoiceCatalog struct {
+	voices atomic.Pointer[Voices]
+
+	mu     sync.Mutex
+	remote Voices
+	custom Voices
+}
+
+func newVoiceCatalog(voices Voices) *VoiceCatalog {
+	c := &VoiceCatalog{custom: make(Voices)}
+	c.set(voices)
+	return c
+}
+
+func initVoiceCatalog() *VoiceCatalog {
+	c := newVoiceCatalog(getAvailableVoices(VOICES_JSON_PATH))
+	if VOICES_CATALOG_REFRESH_HOURS > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(VOICES_CATALOG_REFRESH_HOURS) * time.Hour)
+				if _, err := refreshVoiceCatalog(c); err != nil {
+					log.Printf("Failed to refresh voices catalog: %v", err)
+				}
+			}
+		}()
+	}
+	return c
+}
+
+func (c *VoiceCatalog) get() *Voices {
+	return c.voices.Load()
+}
+
+// set replaces the voices.json catalog. Custom voices are kept, unless the
+// catalog now has a voice with the same key.
+func (c *VoiceCatalog) set(voices Voices) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remote = voices
+	c.publish()
+}
+
+// addCustom adds a custom voice, failing if the key is already taken.
+func (c *VoiceCatalog) addCustom(voice Voice) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := (*c.voices.Load())[voice.Key]; ok {
+		return errVoiceExists
+	}
+	c.custom[voice.Key] = voice
+	c.publish()
+	return nil
+}
+
+func (c *VoiceCatalog) removeCustom(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.custom, key)
+	c.publish()
+}
+
+// publish stores a new snapshot merging the catalog and the custom voices.
+// c.mu must be held.
+func (c *VoiceCatalog) publish() {
+	voices := make(Voices, len(c.remote)+len(c.custom))
+	for key, voice := range c.custom {
+		voices[key] = voice
+	}
+	for key, voice := range c.remote {
+		voices[key] = voice
+	}
+	c.voices.Store(&voices)
+}
+
+// validateVoiceCatalog checks that every voice of a catalog lists a model and
+// a config with their checksums, as downloadVoiceFiles expects.
+func validateVoiceCatalog(voices Voices) error {
+	if len(voices) == 0 {
+		return errors.New("catalog has no voices")
+	}
+	for key, voice := range voices {
+		if voice.Key != key {
+			return fmt.Errorf("voice %s has key %q", key, voice.Key)
+		}
+		for _, suffix := range []string{".onnx", ".onnx.json"} {
+			found := false
+			for fileName, file := range voice.Files {
+				if filepath.Base(fileName) == key+suffix && file.MD5Digest != "" {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("voice %s has no %s file with a checksum", key, suffix)
+			}
+		}
+	}
+	return nil
+}
+
+// fetchVoiceCatalog downloads voices.json from the first of VOICES_MIRRORS
+// that has a valid one.
+func fetchVoiceCatalog() (Voices, error) {
+	var err error
+	for _, mirror := range VOICES_MIRRORS {
+		var voices Voices
+		if voices, err = fetchVoiceCatalogFromMirror(mirror); err == nil {
+			return voices, nil
+		}
+		log.Printf("Failed to fetch voices catalog from '%s': %v\n", mirror, err)
+	}
+	return nil, err
+}
+
+func fetchVoiceCatalogFromMirror(mirror string) (Voices, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(VOICE_DOWNLOAD_TIMEOUT_SECONDS)*time.Second)
+	defer cancel()
+	source, _, err := openMirrorFile(ctx, mirror, "voices.json", 0)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	voices := make(Voices)
+	if err := json.NewDecoder(source).Decode(&voices); err != nil {
+		return nil, err
+	}
+	if err := validateVoiceCatalog(voices); err != nil {
+		return nil, err
+	}
+	return voices, nil
+}
+
+// saveVoiceCatalog atomically replaces the voices.json file at path.
+func saveVoiceCatalog(path string, voices Voices) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := json.NewEncoder(tmp).Encode(voices); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// refreshVoiceCatalog replaces the catalog with the latest voices.json of
+// the voices repository and saves it to VOICES_JSON_PATH. The new catalog is
+// used even if it can't be saved.
+func refreshVoiceCatalog(c *VoiceCatalog) (Voices, error) {
+	voices, err := fetchVoiceCatalog()
+	if err != nil {
+		return nil, err
+	}
+	c.set(voices)
+	log.Printf("Refreshed voices catalog, %d voices available\n", len(voices))
+	if err := saveVoiceCatalog(VOICES_JSON_PATH, voices); err != nil {
+		log.Printf("Failed to save voices catalog to %s: %v", VOICES_JSON_PATH, err)
+	}
+	return voices, nil
+}
+
+func voicesRefreshHandler(catalog *VoiceCatalog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		previous := catalog.get()
+		voices, err := refreshVoiceCatalog(catalog)
+		if err != nil {
+			log.Printf("Failed to refresh voices catalog: %v", err)
+			c.String(http.StatusBadGateway, "Failed to refresh voices catalog: "+err.Error())
+			return
+		}
+		added := 0
+		for key := range voices {
+			if _, ok := (*previous)[key]; !ok {
+				added++
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"voices": len(voices), "added": added})
+	}
+}
+
+// VoiceListEntry is a catalog entry in the list form of GET /api/voices.
+type VoiceListEntry struct {
+	VoiceWithDefaults
+	Installed  bool `json:"installed"`
+	SampleRate int  `json:"sample_rate,omitempty"`
+}
+
+// VoiceListQuery filters, sorts and paginates the catalog. Zero values
+// don't filter.
+type VoiceListQuery struct {
+	Language     string
+	Family       string
+	Quality      string
+	MultiSpeaker bool
+	Installed    bool
+	Search       string
+	Sort         string
+	Descending   bool
+	Cursor       string
+	Limit        int
+}
+
+const (
+	defaultVoiceListLimit = 50
+	maxVoiceListLimit     = 500
+)
+
+// Qualities from the lowest to the highest, for sorting.
+var voiceQualities = map[string]int{"x_low": 0, "low": 1, "medium": 2, "high": 3}
+
+var voiceListSorts = map[string]func(entry VoiceListEntry) string{
+	"key":      func(entry VoiceListEntry) string { return entry.Key },
+	"name":     func(entry VoiceListEntry) string { return strings.ToLower(entry.Name) },
+	"language": func(entry VoiceListEntry) string { return entry.Language.Code },
+	"quality": func(entry VoiceListEntry) string {
+		if rank, ok := voiceQualities[entry.Quality]; ok {
+			return strconv.Itoa(rank)
+		}
+		return entry.Quality
+	},
+}
+
+type voiceListCursor struct {
+	Value string `json:"v"`
+	Key   string `json:"k"`
+}
+
+func encodeVoiceListCursor(cursor voiceListCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeVoiceListCursor(value string) (voiceListCursor, error) {
+	var cursor voiceListCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+func (q VoiceListQuery) matches(entry VoiceListEntry) bool {
+	if q.Language != "" && !strings.EqualFold(entry.Language.Code, q.Language) {
+		return false
+	}
+	if q.Family != "" && !strings.EqualFold(entry.Language.Family, q.Family) {
+		return false
+	}
+	if q.Quality != "" && entry.Quality != q.Quality {
+		return false
+	}
+	if q.MultiSpeaker && entry.NumSpeakers <= 1 {
+		return false
+	}
+	if q.Installed && !entry.Installed {
+		return false
+	}
+	if q.Search != "" {
+		search := strings.ToLower(q.Search)
+		if !strings.Contains(strings.ToLower(entry.Name), search) && !strings.Contains(strings.ToLower(entry.Language.NameEnglish), search) {
+			return false
+		}
+	}
+	return true
+}
+
+// listVoices returns a page of the catalog matching query, along with the
+// cursor of the next page, empty on the last one. Ties are broken by key so
+// that cursors are stable.
+func listVoices(voices *Voices, query VoiceListQuery) ([]VoiceListEntry, string, error) {
+	sortValue, ok := voiceListSorts[query.Sort]
+	if !ok {
+		return nil, "", fmt.Errorf("invalid sort, must be one of key, name, language or quality")
+	}
+	if query.Limit <= 0 || query.Limit > maxVoiceListLimit {
+		return nil, "", fmt.Errorf("invalid limit, must be between 1 and %d", maxVoiceListLimit)
+	}
+
+	entries := make([]VoiceListEntry, 0, len(*voices))
+	for key, voice := range *voices {
+		entry := VoiceListEntry{VoiceWithDefaults: VoiceWithDefaults{Voice: voice}}
+		entry.Key = key
+		if details, ok := voiceRegistry.get(key); ok {
+			inference := details.Inference
+			entry.Inference = &inference
+			entry.Installed = true
+			entry.SampleRate = details.Audio.SampleRate
+		}
+		if query.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	before := func(a, b voiceListCursor) bool {
+		if a.Value != b.Value {
+			return (a.Value < b.Value) != query.Descending
+		}
+		return a.Key < b.Key
+	}
+	position := func(entry VoiceListEntry) voiceListCursor {
+		return voiceListCursor{Value: sortValue(entry), Key: entry.Key}
+	}
+	sort.Slice(entries, func(i, j int) bool { return before(position(entries[i]), position(entries[j])) })
+
+	if query.Cursor != "" {
+		cursor, err := decodeVoiceListCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start := sort.Search(len(entries), func(i int) bool { return before(cursor, position(entries[i])) })
+		entries = entries[start:]
+	}
+
+	next := ""
+	if len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+		next = encodeVoiceListCursor(position(entries[len(entries)-1]))
+	}
+	return entries, next, nil
+}
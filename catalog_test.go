@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCatalog = `{"test-voice":{"key":"test-voice","files":{"en/test-voice.onnx":{"md5_digest":"a"},"en/test-voice.onnx.json":{"md5_digest":"b"}}}}`
+
+// useTempVoicesJSONPath points VOICES_JSON_PATH to a file in an empty directory.
+func useTempVoicesJSONPath(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "voices.json")
+	previous := VOICES_JSON_PATH
+	VOICES_JSON_PATH = path
+	t.Cleanup(func() { VOICES_JSON_PATH = previous })
+	return path
+}
+
+func TestValidateVoiceCatalog_Valid(t *testing.T) {
+	var voices Voices
+	json.Unmarshal([]byte(testCatalog), &voices)
+	if err := validateVoiceCatalog(voices); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateVoiceCatalog_Empty(t *testing.T) {
+	if err := validateVoiceCatalog(Voices{}); err == nil {
+		t.Fatal("expected error for empty catalog")
+	}
+}
+
+func TestValidateVoiceCatalog_MissingModel(t *testing.T) {
+	voices := Voices{"test-voice": {Key: "test-voice", Files: map[string]File{"en/test-voice.onnx.json": {MD5Digest: "b"}}}}
+	if err := validateVoiceCatalog(voices); err == nil {
+		t.Fatal("expected error for voice without model")
+	}
+}
+
+func TestVoicesRefreshHandler_SwapsAndSavesCatalog(t *testing.T) {
+	path := useTempVoicesJSONPath(t)
+	useVoicesRepo(t, map[string]string{"/voices.json": testCatalog}, nil)
+	catalog := newVoiceCatalog(Voices{})
+	previous := catalog.get()
+
+	c, w := newTestContext("POST", "/api/voices/refresh", "")
+	voicesRefreshHandler(catalog)(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := (*catalog.get())["test-voice"]; !ok {
+		t.Fatal("expected refreshed catalog to be used")
+	}
+	if len(*previous) != 0 {
+		t.Fatal("expected previous snapshot to be left untouched")
+	}
+
+	var saved Voices
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected catalog to be saved: %v", err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved) != 1 {
+		t.Fatalf("unexpected saved catalog %s", data)
+	}
+}
+
+func TestVoicesRefreshHandler_KeepsCatalogOnInvalidJSON(t *testing.T) {
+	useTempVoicesJSONPath(t)
+	useVoicesRepo(t, map[string]string{"/voices.json": `{"broken": {"key": "other"}}`}, nil)
+	catalog := newVoiceCatalog(Voices{"existing": {}})
+
+	c, w := newTestContext("POST", "/api/voices/refresh", "")
+	voicesRefreshHandler(catalog)(c)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", w.Code)
+	}
+	if _, ok := (*catalog.get())["existing"]; !ok {
+		t.Fatal("expected catalog to be kept")
+	}
+}
+
+func testListVoices() Voices {
+	return Voices{
+		"en_US-amy-low":       {Key: "en_US-amy-low", Name: "amy", Quality: "low", NumSpeakers: 1, Language: Language{Code: "en_US", Family: "en", NameEnglish: "English"}},
+		"en_US-libritts-high": {Key: "en_US-libritts-high", Name: "libritts", Quality: "high", NumSpeakers: 904, Language: Language{Code: "en_US", Family: "en", NameEnglish: "English"}},
+		"en_GB-alan-medium":   {Key: "en_GB-alan-medium", Name: "alan", Quality: "medium", NumSpeakers: 1, Language: Language{Code: "en_GB", Family: "en", NameEnglish: "English"}},
+		"fr_FR-siwis-x_low":   {Key: "fr_FR-siwis-x_low", Name: "siwis", Quality: "x_low", NumSpeakers: 1, Language: Language{Code: "fr_FR", Family: "fr", NameEnglish: "French"}},
+	}
+}
+
+func listedKeys(entries []VoiceListEntry) []string {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return keys
+}
+
+func TestListVoices_Filters(t *testing.T) {
+	voices := testListVoices()
+	voiceRegistry.set("en_GB-alan-medium", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 22050}})
+	defer voiceRegistry.remove("en_GB-alan-medium")
+
+	cases := []struct {
+		query VoiceListQuery
+		want  string
+	}{
+		{VoiceListQuery{Language: "en_us"}, "en_US-amy-low,en_US-libritts-high"},
+		{VoiceListQuery{Family: "fr"}, "fr_FR-siwis-x_low"},
+		{VoiceListQuery{Quality: "medium"}, "en_GB-alan-medium"},
+		{VoiceListQuery{MultiSpeaker: true}, "en_US-libritts-high"},
+		{VoiceListQuery{Installed: true}, "en_GB-alan-medium"},
+		{VoiceListQuery{Search: "FRENCH"}, "fr_FR-siwis-x_low"},
+		{VoiceListQuery{Search: "ami"}, ""},
+		{VoiceListQuery{Search: "am"}, "en_US-amy-low"},
+	}
+	for _, tc := range cases {
+		tc.query.Sort = "key"
+		tc.query.Limit = 10
+		entries, _, err := listVoices(&voices, tc.query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := strings.Join(listedKeys(entries), ","); got != tc.want {
+			t.Fatalf("query %+v: expected %q, got %q", tc.query, tc.want, got)
+		}
+	}
+}
+
+func TestListVoices_InstalledEntryHasSampleRate(t *testing.T) {
+	voices := testListVoices()
+	voiceRegistry.set("en_GB-alan-medium", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 22050}})
+	defer voiceRegistry.remove("en_GB-alan-medium")
+
+	entries, _, _ := listVoices(&voices, VoiceListQuery{Quality: "medium", Sort: "key", Limit: 10})
+	if len(entries) != 1 || !entries[0].Installed || entries[0].SampleRate != 22050 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
+
+func TestListVoices_SortsByQuality(t *testing.T) {
+	voices := testListVoices()
+	entries, _, err := listVoices(&voices, VoiceListQuery{Sort: "quality", Descending: true, Limit: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "en_US-libritts-high,en_GB-alan-medium,en_US-amy-low,fr_FR-siwis-x_low"
+	if got := strings.Join(listedKeys(entries), ","); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestListVoices_PaginatesWithCursor(t *testing.T) {
+	voices := testListVoices()
+	var pages []string
+	query := VoiceListQuery{Sort: "name", Limit: 3}
+	for {
+		entries, next, err := listVoices(&voices, query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		pages = append(pages, strings.Join(listedKeys(entries), ","))
+		if next == "" {
+			break
+		}
+		query.Cursor = next
+	}
+	want := []string{"en_GB-alan-medium,en_US-amy-low,en_US-libritts-high", "fr_FR-siwis-x_low"}
+	if strings.Join(pages, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected pages %q, got %q", want, pages)
+	}
+}
+
+func TestListVoices_InvalidCursor(t *testing.T) {
+	voices := testListVoices()
+	if _, _, err := listVoices(&voices, VoiceListQuery{Sort: "key", Limit: 10, Cursor: "not a cursor"}); err == nil {
+		t.Fatal("expected error for invalid cursor")
+	}
+}
@@ -3,16 +3,45 @@ package main
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 var VOICES_PATH = getEnv("VOICES_PATH", "/voices")
 var VOICES_JSON_PATH = getEnv("VOICES_JSON_PATH", "/app/voices.json")
 var PIPER_BINARY = getEnv("PIPER_BINARY", "/usr/share/piper/piper")
 var STREAM_EXPIRATION_MINUTES = getIntEnv("STREAM_EXPIRATION_MINUTES", "15")
+var PIPER_MIN_WORKERS = getIntEnv("PIPER_MIN_WORKERS", "0")
+var PIPER_MAX_WORKERS = getIntEnv("PIPER_MAX_WORKERS", "2")
+var PIPER_MAX_PROCESSES = getIntEnv("PIPER_MAX_PROCESSES", "4")
+var PIPER_WORKER_IDLE_MINUTES = getIntEnv("PIPER_WORKER_IDLE_MINUTES", "5")
+var PIPER_UTTERANCE_TIMEOUT_SECONDS = getIntEnv("PIPER_UTTERANCE_TIMEOUT_SECONDS", "120")
+var SENTENCE_PAUSE_MS = getIntEnv("SENTENCE_PAUSE_MS", "0")
+var OPENAI_VOICE_MAP = getMapEnv("OPENAI_VOICE_MAP", "alloy=en_US-amy-medium,ash=en_US-hfc_male-medium,coral=en_US-hfc_female-medium,echo=en_US-ryan-medium,fable=en_GB-alan-medium,onyx=en_US-joe-medium,nova=en_US-kristin-medium,sage=en_GB-jenny_dioco-medium,shimmer=en_US-lessac-medium")
+var WYOMING_PORT = getEnv("WYOMING_PORT", "")
+var AUDIO_CACHE_PATH = getEnv("AUDIO_CACHE_PATH", "")
+var AUDIO_CACHE_MAX_MB = getIntEnv("AUDIO_CACHE_MAX_MB", "512")
+var JOB_WORKERS = getIntEnv("JOB_WORKERS", "1")
+var JOB_QUEUE_SIZE = getIntEnv("JOB_QUEUE_SIZE", "100")
+var JOB_EXPIRATION_MINUTES = getIntEnv("JOB_EXPIRATION_MINUTES", "60")
+var JOBS_PATH = getEnv("JOBS_PATH", filepath.Join(os.TempDir(), "gopipertts-jobs"))
+var JOB_CALLBACK_SECRET = getEnv("JOB_CALLBACK_SECRET", "")
+var JOB_CALLBACK_ALLOWED_HOSTS = getListEnv("JOB_CALLBACK_ALLOWED_HOSTS", "")
+var VOICES_MIRRORS = getListEnv("VOICES_MIRRORS", "https://huggingface.co/rhasspy/piper-voices/resolve/main")
+var VOICES_CATALOG_REFRESH_HOURS = getIntEnv("VOICES_CATALOG_REFRESH_HOURS", "0")
+var VOICE_DOWNLOAD_RETRIES = getIntEnv("VOICE_DOWNLOAD_RETRIES", "3")
+var VOICE_DOWNLOAD_TIMEOUT_SECONDS = getIntEnv("VOICE_DOWNLOAD_TIMEOUT_SECONDS", "600")
+var VOICES_WATCH_INTERVAL_SECONDS = getIntEnv("VOICES_WATCH_INTERVAL_SECONDS", "10")
+var VOICES_MAX_MB = getIntEnv("VOICES_MAX_MB", "0")
+var VOICE_DOWNLOAD_ON_DEMAND = getBoolEnv("VOICE_DOWNLOAD_ON_DEMAND", "true")
+var PRELOAD_VOICES = getListEnv("PRELOAD_VOICES", "")
+var VOICE_LANGUAGE_DEFAULTS = getMapEnv("VOICE_LANGUAGE_DEFAULTS", "")
+var PRESETS_PATH = getEnv("PRESETS_PATH", "")
+var OPUS_BITRATE = getEnv("OPUS_BITRATE", "32k")
 var logInput = os.Getenv("LOG_INPUT") != ""
 
-const VOICES_REPO_BASE_URL = "https://huggingface.co/rhasspy/piper-voices/resolve/main"
+const DEFAULT_VOICE = "en_US-amy-low"
 
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
@@ -30,3 +59,40 @@ func getIntEnv(key, defaultValue string) int {
 	}
 	return intValue
 }
+
+func getBoolEnv(key, defaultValue string) bool {
+	value := getEnv(key, defaultValue)
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %s", key, value)
+	}
+	return boolValue
+}
+
+// getMapEnv parses a comma separated list of key=value pairs.
+func getMapEnv(key, defaultValue string) map[string]string {
+	value := getEnv(key, defaultValue)
+	result := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Fatalf("Invalid value for %s: %s", key, pair)
+		}
+		result[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return result
+}
+
+// getListEnv parses a comma separated list.
+func getListEnv(key, defaultValue string) []string {
+	var result []string
+	for _, item := range strings.Split(getEnv(key, defaultValue), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
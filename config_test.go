@@ -33,3 +33,39 @@ func TestGetIntEnv_ReturnsDefaultWhenUnset(t *testing.T) {
 		t.Fatalf("expected 15, got %d", result)
 	}
 }
+
+func TestGetMapEnv_ParsesPairs(t *testing.T) {
+	t.Setenv("TEST_MAP_GOSTREAM", "alloy=en_US-amy-low, echo = en_US-ryan-low,")
+	result := getMapEnv("TEST_MAP_GOSTREAM", "")
+	if len(result) != 2 {
+		t.Fatalf("expected 2 entries, got %v", result)
+	}
+	if result["alloy"] != "en_US-amy-low" || result["echo"] != "en_US-ryan-low" {
+		t.Fatalf("unexpected map %v", result)
+	}
+}
+
+func TestGetMapEnv_ReturnsDefaultWhenUnset(t *testing.T) {
+	result := getMapEnv("TEST_MAP_GOSTREAM_UNSET_XYZ", "a=b")
+	if result["a"] != "b" {
+		t.Fatalf("expected default map, got %v", result)
+	}
+}
+
+func TestGetListEnv_SkipsEmptyItems(t *testing.T) {
+	t.Setenv("TEST_LIST_GOSTREAM", "https://a.example, /voices ,,")
+	result := getListEnv("TEST_LIST_GOSTREAM", "")
+	if len(result) != 2 || result[0] != "https://a.example" || result[1] != "/voices" {
+		t.Fatalf("unexpected list %q", result)
+	}
+}
+
+func TestGetBoolEnv_ParsesValue(t *testing.T) {
+	t.Setenv("TEST_BOOL_GOSTREAM", "false")
+	if getBoolEnv("TEST_BOOL_GOSTREAM", "true") {
+		t.Fatal("expected false")
+	}
+	if !getBoolEnv("TEST_BOOL_GOSTREAM_UNSET_XYZ", "true") {
+		t.Fatal("expected default true")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errVoiceExists        = errors.New("voice already exists")
+	errInvalidCustomVoice = errors.New("invalid custom voice")
+)
+
+// Uploads are installed one at a time, so that two uploads of a key can't
+// overwrite each other's files, and apart from the rescans of VOICES_PATH.
+var customVoiceUploads sync.Mutex
+
+// Keys of custom voices, which are also their file names in VOICES_PATH.
+var customVoiceKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// customVoiceConfig is the part of a piper voice config describing the voice,
+// used to build its catalog entry.
+type customVoiceConfig struct {
+	Dataset string `json:"dataset"`
+	Audio   struct {
+		Quality string `json:"quality"`
+	} `json:"audio"`
+	Language     Language               `json:"language"`
+	NumSpeakers  int                    `json:"num_speakers"`
+	SpeakerIDMap map[string]interface{} `json:"speaker_id_map"`
+}
+
+// newCustomVoice builds the catalog entry of a voice installed in VOICES_PATH
+// from its config. Its files are listed with their actual checksums.
+func newCustomVoice(key string) (Voice, error) {
+	voice := Voice{Key: key, Name: key, Custom: true, Files: make(map[string]File)}
+	for _, fileName := range []string{key + ".onnx", key + ".onnx.json"} {
+		info, err := os.Stat(voiceFilePath(fileName))
+		if err != nil {
+			return voice, err
+		}
+		sum, err := fileMD5(voiceFilePath(fileName))
+		if err != nil {
+			return voice, err
+		}
+		voice.Files[fileName] = File{SizeBytes: info.Size(), MD5Digest: sum}
+	}
+
+	data, err := os.ReadFile(voiceFilePath(key + ".onnx.json"))
+	if err != nil {
+		return voice, err
+	}
+	var config customVoiceConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return voice, err
+	}
+	if config.Dataset != "" {
+		voice.Name = config.Dataset
+	}
+	voice.Quality = config.Audio.Quality
+	voice.Language = config.Language
+	voice.NumSpeakers = config.NumSpeakers
+	if voice.NumSpeakers == 0 {
+		voice.NumSpeakers = 1
+	}
+	voice.SpeakerIDMap = config.SpeakerIDMap
+	return voice, nil
+}
+
+// loadCustomVoices adds the voices installed in VOICES_PATH that aren't in
+// the catalog as custom voices, so uploaded voices survive restarts.
+func loadCustomVoices(catalog *VoiceCatalog) {
+	voices := catalog.get()
+	for _, key := range voiceRegistry.names() {
+		if _, ok := (*voices)[key]; ok {
+			continue
+		}
+		voice, err := newCustomVoice(key)
+		if err != nil {
+			log.Printf("Failed to load custom voice %s: %v", key, err)
+			continue
+		}
+		if err := catalog.addCustom(voice); err != nil {
+			log.Printf("Failed to load custom voice %s: %v", key, err)
+			continue
+		}
+		log.Printf("Loaded custom voice %s\n", key)
+	}
+}
+
+// installCustomVoice stores an uploaded model and config in VOICES_PATH. The
+// config must parse and declare a sample rate, errInvalidCustomVoice being
+// returned otherwise. Files are written next to their destination and only
+// renamed into place once valid.
+func installCustomVoice(c *gin.Context, key string, model *multipart.FileHeader, config *multipart.FileHeader) (VoiceDetails, error) {
+	modelPath := voiceFilePath(key + ".onnx")
+	configPath := voiceFilePath(key + ".onnx.json")
+	defer os.Remove(modelPath + partialDownloadSuffix)
+	defer os.Remove(configPath + partialDownloadSuffix)
+
+	if err := c.SaveUploadedFile(config, configPath+partialDownloadSuffix); err != nil {
+		return VoiceDetails{}, err
+	}
+	details, err := parseVoiceDetails(configPath + partialDownloadSuffix)
+	if err != nil {
+		return VoiceDetails{}, fmt.Errorf("%w: config doesn't parse: %v", errInvalidCustomVoice, err)
+	}
+	if details.Audio.SampleRate <= 0 {
+		return VoiceDetails{}, fmt.Errorf("%w: config has no audio.sample_rate", errInvalidCustomVoice)
+	}
+
+	if err := c.SaveUploadedFile(model, modelPath+partialDownloadSuffix); err != nil {
+		return VoiceDetails{}, err
+	}
+	// The model goes first, a config alone isn't loaded as a voice
+	if err := os.Rename(modelPath+partialDownloadSuffix, modelPath); err != nil {
+		return VoiceDetails{}, err
+	}
+	if err := os.Rename(configPath+partialDownloadSuffix, configPath); err != nil {
+		os.Remove(modelPath)
+		return VoiceDetails{}, err
+	}
+	return details, nil
+}
+
+// customVoiceUploadHandler installs a voice from a multipart "model" .onnx
+// file and its "config" .onnx.json file. The voice key is the "key" field,
+// or the model file name without its extension.
+func customVoiceUploadHandler(catalog *VoiceCatalog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		model, err := c.FormFile("model")
+		if err != nil {
+			c.String(http.StatusBadRequest, "model file is required")
+			return
+		}
+		config, err := c.FormFile("config")
+		if err != nil {
+			c.String(http.StatusBadRequest, "config file is required")
+			return
+		}
+		if !strings.HasSuffix(model.Filename, ".onnx") || !strings.HasSuffix(config.Filename, ".onnx.json") {
+			c.String(http.StatusBadRequest, "model must be a .onnx file and config a .onnx.json file")
+			return
+		}
+		key := c.PostForm("key")
+		if key == "" {
+			key = strings.TrimSuffix(model.Filename, ".onnx")
+		}
+		if !customVoiceKeyPattern.MatchString(key) {
+			c.String(http.StatusBadRequest, "invalid key, only letters, digits, '_' and '-' are allowed")
+			return
+		}
+
+		customVoiceUploads.Lock()
+		defer customVoiceUploads.Unlock()
+		if _, ok := (*catalog.get())[key]; ok {
+			c.String(http.StatusConflict, "Voice already exists")
+			return
+		}
+		if _, ok := voiceRegistry.get(key); ok {
+			c.String(http.StatusConflict, "Voice already exists")
+			return
+		}
+
+		// Uploads count against VOICES_MAX_MB like downloads, the multipart
+		// sizes being known before anything is written
+		if err := voiceRegistry.reserveBytes(catalog.get(), key, model.Size+config.Size); err == errVoicesQuotaExceeded {
+			c.String(http.StatusInsufficientStorage, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("Failed to reserve space for custom voice %s: %v", key, err)
+			c.String(http.StatusInternalServerError, "Failed to install custom voice")
+			return
+		}
+		defer voiceRegistry.release(key)
+
+		details, err := installCustomVoice(c, key, model, config)
+		if errors.Is(err, errInvalidCustomVoice) {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("Failed to install custom voice %s: %v", key, err)
+			c.String(http.StatusInternalServerError, "Failed to install custom voice")
+			return
+		}
+		voice, err := newCustomVoice(key)
+		if err == nil {
+			err = catalog.addCustom(voice)
+		}
+		if err != nil {
+			deleteVoiceFiles(voice)
+			if err == errVoiceExists {
+				c.String(http.StatusConflict, "Voice already exists")
+				return
+			}
+			log.Printf("Failed to install custom voice %s: %v", key, err)
+			c.String(http.StatusInternalServerError, "Failed to install custom voice")
+			return
+		}
+		voiceRegistry.set(key, details)
+		log.Printf("Installed custom voice %s\n", key)
+		c.JSON(http.StatusCreated, getVoiceStatus(key, voice))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testCustomVoiceConfig = `{"dataset":"team","audio":{"sample_rate":22050,"quality":"medium"},"language":{"code":"en_US","family":"en"},"num_speakers":1}`
+
+// newUploadContext builds a multipart request with the given form files and
+// fields.
+func newUploadContext(t *testing.T, files map[string][2]string, fields map[string]string) (*gin.Context, *httptest.ResponseRecorder) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for field, file := range files {
+		part, err := form.CreateFormFile(field, file[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(file[1]))
+	}
+	for field, value := range fields {
+		form.WriteField(field, value)
+	}
+	form.Close()
+
+	c, w := newTestContext("POST", "/api/voices/custom", "")
+	c.Request = httptest.NewRequest("POST", "/api/voices/custom", body)
+	c.Request.Header.Set("Content-Type", form.FormDataContentType())
+	return c, w
+}
+
+func TestCustomVoiceUploadHandler_InstallsVoice(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	catalog := newVoiceCatalog(Voices{})
+	defer voiceRegistry.remove("team-voice")
+
+	c, w := newUploadContext(t, map[string][2]string{
+		"model":  {"team-voice.onnx", "model"},
+		"config": {"team-voice.onnx.json", testCustomVoiceConfig},
+	}, nil)
+	customVoiceUploadHandler(catalog)(c)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	voice, ok := (*catalog.get())["team-voice"]
+	if !ok || !voice.Custom || voice.Name != "team" || voice.Language.Code != "en_US" || voice.Quality != "medium" {
+		t.Fatalf("unexpected catalog entry %+v", voice)
+	}
+	if details, ok := voiceRegistry.get("team-voice"); !ok || details.Audio.SampleRate != 22050 {
+		t.Fatalf("expected voice to be installed, got %+v", details)
+	}
+	for _, name := range []string{"team-voice.onnx", "team-voice.onnx.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("expected %s to be stored: %v", name, err)
+		}
+	}
+	if status := getVoiceStatus("team-voice", voice); status.Files["team-voice.onnx"].Checksum != "ok" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestCustomVoiceUploadHandler_RequiresSampleRate(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	catalog := newVoiceCatalog(Voices{})
+
+	c, w := newUploadContext(t, map[string][2]string{
+		"model":  {"team-voice.onnx", "model"},
+		"config": {"team-voice.onnx.json", `{"audio":{}}`},
+	}, nil)
+	customVoiceUploadHandler(catalog)(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body.String())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected no file to be left behind, got %d", len(files))
+	}
+}
+
+func TestCustomVoiceUploadHandler_RejectsCatalogKey(t *testing.T) {
+	useTempVoicesPath(t)
+	catalog := newVoiceCatalog(Voices{"en_US-amy-low": {Key: "en_US-amy-low"}})
+
+	c, w := newUploadContext(t, map[string][2]string{
+		"model":  {"model.onnx", "model"},
+		"config": {"model.onnx.json", testCustomVoiceConfig},
+	}, map[string]string{"key": "en_US-amy-low"})
+	customVoiceUploadHandler(catalog)(c)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", w.Code)
+	}
+}
+
+func TestCustomVoiceUploadHandler_QuotaExceeded(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	useVoicesQuota(t, 1)
+	catalog := newVoiceCatalog(Voices{})
+
+	c, w := newUploadContext(t, map[string][2]string{
+		"model":  {"team-voice.onnx", string(make([]byte, 2*1024*1024))},
+		"config": {"team-voice.onnx.json", testCustomVoiceConfig},
+	}, nil)
+	customVoiceUploadHandler(catalog)(c)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507, got %d: %s", w.Code, w.Body.String())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected nothing to be written, got %v", files)
+	}
+	if _, ok := (*catalog.get())["team-voice"]; ok {
+		t.Fatal("expected voice not to be added")
+	}
+}
+
+func TestCustomVoiceUploadHandler_InvalidKey(t *testing.T) {
+	useTempVoicesPath(t)
+	c, w := newUploadContext(t, map[string][2]string{
+		"model":  {"model.onnx", "model"},
+		"config": {"model.onnx.json", testCustomVoiceConfig},
+	}, map[string]string{"key": "../escape"})
+	customVoiceUploadHandler(newVoiceCatalog(Voices{}))(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestVoiceCatalog_KeepsCustomVoicesOnRefresh(t *testing.T) {
+	catalog := newVoiceCatalog(Voices{"remote": {Key: "remote"}})
+	if err := catalog.addCustom(Voice{Key: "custom", Custom: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := catalog.addCustom(Voice{Key: "remote", Custom: true}); err != errVoiceExists {
+		t.Fatalf("expected errVoiceExists, got %v", err)
+	}
+
+	catalog.set(Voices{"other": {Key: "other"}})
+	voices := *catalog.get()
+	if _, ok := voices["custom"]; !ok || len(voices) != 2 {
+		t.Fatalf("expected custom voice to be kept, got %v", voices)
+	}
+
+	catalog.removeCustom("custom")
+	if _, ok := (*catalog.get())["custom"]; ok {
+		t.Fatal("expected custom voice to be removed")
+	}
+}
+
+func TestLoadCustomVoices(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	os.WriteFile(filepath.Join(dir, "team-voice.onnx"), []byte("model"), 0644)
+	os.WriteFile(filepath.Join(dir, "team-voice.onnx.json"), []byte(testCustomVoiceConfig), 0644)
+	voiceRegistry.set("team-voice", VoiceDetails{})
+	defer voiceRegistry.remove("team-voice")
+	catalog := newVoiceCatalog(Voices{})
+
+	loadCustomVoices(catalog)
+	if voice, ok := (*catalog.get())["team-voice"]; !ok || !voice.Custom {
+		t.Fatalf("expected custom voice to be loaded, got %+v", voice)
+	}
+}
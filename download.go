@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Suffix of the partial files voices are downloaded to. They are kept when a
+// download fails so the next attempt can resume them.
+const partialDownloadSuffix = ".part"
+
+// Delay before the first retry of a failed download, doubled for each
+// following retry.
+var voiceDownloadBackoff = time.Second
+
+// progressWriter counts the bytes written to it.
+type progressWriter struct {
+	written int64
+	onWrite func(written int64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	w.onWrite(w.written)
+	return len(p), nil
+}
+
+func (w *progressWriter) set(written int64) {
+	w.written = written
+	w.onWrite(written)
+}
+
+// downloadVoiceFile downloads a catalog file from the first of VOICES_MIRRORS
+// that has it, retrying with exponential backoff. The file is written to a
+// partial file that is resumed on retries and only renamed into place once
+// its MD5 matched, so an interrupted download never leaves a partial model
+// behind.
+func downloadVoiceFile(fileName string, fileInfo File, progress *progressWriter) error {
+	filePath := voiceFilePath(fileName)
+	partPath := filePath + partialDownloadSuffix
+
+	var err error
+	for attempt := 0; attempt <= VOICE_DOWNLOAD_RETRIES; attempt++ {
+		if attempt > 0 {
+			delay := voiceDownloadBackoff << (attempt - 1)
+			log.Printf("Retrying download of '%s' in %v\n", fileName, delay)
+			time.Sleep(delay)
+		}
+		for _, mirror := range VOICES_MIRRORS {
+			log.Printf("Downloading '%s' from '%s' to '%s'\n", fileName, mirror, filePath)
+			if err = downloadFromMirror(mirror, fileName, partPath, progress); err == nil {
+				break
+			}
+			log.Printf("Failed to download '%s' from '%s': %v\n", fileName, mirror, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		if err = verifyDownload(partPath, fileName, fileInfo.MD5Digest); err != nil {
+			// Resuming a corrupted file can't fix it
+			os.Remove(partPath)
+			log.Println(err)
+			continue
+		}
+		if err = os.Rename(partPath, filePath); err != nil {
+			return err
+		}
+		log.Printf("Downloaded '%s' to '%s'\n", fileName, filePath)
+		return nil
+	}
+	return err
+}
+
+func verifyDownload(partPath string, fileName string, md5Digest string) error {
+	got, err := fileMD5(partPath)
+	if err != nil {
+		return err
+	}
+	if got != md5Digest {
+		return fmt.Errorf("MD5 mismatch for %s: got %s, want %s", fileName, got, md5Digest)
+	}
+	return nil
+}
+
+// downloadFromMirror appends the rest of a file to its partial download,
+// starting over when the mirror can't resume it.
+func downloadFromMirror(mirror string, fileName string, partPath string, progress *progressWriter) error {
+	part, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	offset, err := part.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(VOICE_DOWNLOAD_TIMEOUT_SECONDS)*time.Second)
+	defer cancel()
+	source, offset, err := openMirrorFile(ctx, mirror, fileName, offset)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if err := part.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	progress.set(offset)
+	if _, err := io.Copy(io.MultiWriter(part, progress), source); err != nil {
+		return err
+	}
+	return part.Close()
+}
+
+// openMirrorFile opens a file of the voices repository from offset on. A
+// mirror is either an http(s) URL or a local directory, optionally as a
+// file:// URL. It returns the offset the reader actually starts at, which is
+// 0 when an HTTP server ignores the Range header. A partial response that
+// doesn't start at offset is given up on and the whole file is requested
+// instead.
+func openMirrorFile(ctx context.Context, mirror string, fileName string, offset int64) (io.ReadCloser, int64, error) {
+	if !strings.HasPrefix(mirror, "http://") && !strings.HasPrefix(mirror, "https://") {
+		dir := strings.TrimPrefix(mirror, "file://")
+		file, err := os.Open(filepath.Join(dir, filepath.FromSlash(fileName)))
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		return file, offset, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(mirror, "/")+"/"+fileName, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, 0, nil
+	case http.StatusPartialContent:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); ok && start == offset {
+			return resp.Body, offset, nil
+		}
+		resp.Body.Close()
+		log.Printf("Mirror '%s' answered with Content-Range '%s' for offset %d of '%s', downloading it from the start\n", mirror, resp.Header.Get("Content-Range"), offset, fileName)
+		return openMirrorFile(ctx, mirror, fileName, 0)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is already complete, the MD5 check tells if it's valid
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), offset, nil
+	}
+	resp.Body.Close()
+	return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// contentRangeStart returns the first byte position of a Content-Range
+// header such as "bytes 100-199/200".
+func contentRangeStart(contentRange string) (int64, bool) {
+	var start, end int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &start, &end); err != nil {
+		return 0, false
+	}
+	return start, true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useVoicesMirrors sets the mirrors voices are downloaded from, with a single
+// fast retry.
+func useVoicesMirrors(t *testing.T, mirrors ...string) {
+	t.Helper()
+	previousMirrors, previousRetries, previousBackoff := VOICES_MIRRORS, VOICE_DOWNLOAD_RETRIES, voiceDownloadBackoff
+	VOICES_MIRRORS = mirrors
+	VOICE_DOWNLOAD_RETRIES = 1
+	voiceDownloadBackoff = time.Millisecond
+	t.Cleanup(func() {
+		VOICES_MIRRORS, VOICE_DOWNLOAD_RETRIES, voiceDownloadBackoff = previousMirrors, previousRetries, previousBackoff
+	})
+}
+
+func newTestProgress() *progressWriter {
+	return &progressWriter{onWrite: func(int64) {}}
+}
+
+func TestDownloadVoiceFile_ResumesPartialFile(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "test-voice.onnx", time.Time{}, bytes.NewReader([]byte("model")))
+	}))
+	defer server.Close()
+	useVoicesMirrors(t, server.URL)
+	os.WriteFile(filepath.Join(dir, "test-voice.onnx"+partialDownloadSuffix), []byte("mo"), 0644)
+
+	progress := newTestProgress()
+	if err := downloadVoiceFile("en/test-voice.onnx", File{MD5Digest: md5Hex("model")}, progress); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=2-" {
+		t.Fatalf("expected a single resumed request, got %q", ranges)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "test-voice.onnx")); string(data) != "model" {
+		t.Fatalf("unexpected file content %q", data)
+	}
+	if progress.written != 5 {
+		t.Fatalf("expected progress to include resumed bytes, got %d", progress.written)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test-voice.onnx"+partialDownloadSuffix)); !os.IsNotExist(err) {
+		t.Fatal("expected partial file to be renamed")
+	}
+}
+
+func TestDownloadVoiceFile_RestartsOnMismatchedContentRange(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if r.Header.Get("Range") != "" {
+			// A range starting before the requested offset
+			w.Header().Set("Content-Range", "bytes 0-4/5")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("model"))
+			return
+		}
+		w.Write([]byte("model"))
+	}))
+	defer server.Close()
+	useVoicesMirrors(t, server.URL)
+	os.WriteFile(filepath.Join(dir, "test-voice.onnx"+partialDownloadSuffix), []byte("mo"), 0644)
+
+	if err := downloadVoiceFile("en/test-voice.onnx", File{MD5Digest: md5Hex("model")}, newTestProgress()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ranges) != 2 || ranges[0] != "bytes=2-" || ranges[1] != "" {
+		t.Fatalf("expected a resumed request then a full one, got %q", ranges)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "test-voice.onnx")); string(data) != "model" {
+		t.Fatalf("unexpected file content %q", data)
+	}
+}
+
+func TestDownloadVoiceFile_FallsBackToLocalMirror(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	mirror := t.TempDir()
+	os.MkdirAll(filepath.Join(mirror, "en"), 0755)
+	os.WriteFile(filepath.Join(mirror, "en", "test-voice.onnx"), []byte("model"), 0644)
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	useVoicesMirrors(t, server.URL, "file://"+mirror)
+
+	if err := downloadVoiceFile("en/test-voice.onnx", File{MD5Digest: md5Hex("model")}, newTestProgress()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "test-voice.onnx")); string(data) != "model" {
+		t.Fatalf("unexpected file content %q", data)
+	}
+}
+
+func TestDownloadVoiceFile_RetriesFailures(t *testing.T) {
+	useTempVoicesPath(t)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("model"))
+	}))
+	defer server.Close()
+	useVoicesMirrors(t, server.URL)
+
+	if err := downloadVoiceFile("en/test-voice.onnx", File{MD5Digest: md5Hex("model")}, newTestProgress()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestDownloadVoiceFile_GivesUpAfterRetries(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("corrupted"))
+	}))
+	defer server.Close()
+	useVoicesMirrors(t, server.URL)
+
+	if err := downloadVoiceFile("en/test-voice.onnx", File{MD5Digest: md5Hex("model")}, newTestProgress()); err == nil {
+		t.Fatal("expected checksum error")
+	}
+	if requests != 2 {
+		t.Fatalf("expected 2 requests, got %d", requests)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected no file to be left behind, got %v", files)
+	}
+}
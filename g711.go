@@ -0,0 +1,80 @@
+package main
+
+import "io"
+
+// Sample rate of G.711 telephony audio.
+const g711SampleRate = 8000
+
+// g711Format is a G.711 output format, encoded in Go at g711SampleRate.
+type g711Format struct {
+	Encode func(int16) byte
+	// WAV audio format code, when wrapped in a WAV file rather than raw
+	WAVFormat int
+}
+
+// G.711 output formats, raw or wrapped in a WAV file for players that need a
+// header.
+var g711Formats = map[string]g711Format{
+	"ulaw":     {Encode: linearToMuLaw},
+	"alaw":     {Encode: linearToALaw},
+	"ulaw-wav": {Encode: linearToMuLaw, WAVFormat: wavFormatMuLaw},
+	"alaw-wav": {Encode: linearToALaw, WAVFormat: wavFormatALaw},
+}
+
+// newG711Encoder returns a reader of raw PCM audio at sampleRate resampled to
+// g711SampleRate and companded to one byte per sample.
+func newG711Encoder(audio io.Reader, sampleRate int, format g711Format) io.Reader {
+	return newPCMConvertReader(newResampler(audio, sampleRate, g711SampleRate), func(out []byte, sample int16) []byte {
+		return append(out, format.Encode(sample))
+	})
+}
+
+// Bias and clipping level of mu-law, in 16 bit samples.
+const (
+	muLawBias = 0x84
+	muLawClip = 32635
+)
+
+// linearToMuLaw encodes a sample with the G.711 mu-law.
+func linearToMuLaw(sample int16) byte {
+	value := int(sample)
+	var sign byte
+	if value < 0 {
+		sign = 0x80
+		value = -value
+	}
+	value = min(value, muLawClip) + muLawBias
+
+	exponent := 7
+	for mask := 0x4000; value&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := value >> (exponent + 3) & 0x0F
+	return ^(sign | byte(exponent<<4) | byte(mantissa))
+}
+
+// linearToALaw encodes a sample with the G.711 A-law, which works on 13 bit
+// samples.
+func linearToALaw(sample int16) byte {
+	value := int(sample) >> 3
+	var mask byte = 0xD5
+	if value < 0 {
+		mask = 0x55
+		value = -value - 1
+	}
+
+	segment := 0
+	for segment < 8 && value >= 0x20<<segment {
+		segment++
+	}
+	if segment == 8 {
+		return 0x7F ^ mask
+	}
+	encoded := byte(segment << 4)
+	if segment < 2 {
+		encoded |= byte(value >> 1 & 0x0F)
+	} else {
+		encoded |= byte(value >> segment & 0x0F)
+	}
+	return encoded ^ mask
+}
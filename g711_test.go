@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+)
+
+// muLawToLinear and aLawToLinear are the G.711 decoders.
+func muLawToLinear(encoded byte) int16 {
+	encoded = ^encoded
+	exponent := int(encoded>>4) & 0x07
+	value := (int(encoded&0x0F)<<3 + muLawBias) << exponent
+	if encoded&0x80 != 0 {
+		return int16(muLawBias - value)
+	}
+	return int16(value - muLawBias)
+}
+
+func aLawToLinear(encoded byte) int16 {
+	encoded ^= 0x55
+	value := int(encoded&0x0F) << 4
+	switch segment := int(encoded&0x70) >> 4; segment {
+	case 0:
+		value += 8
+	case 1:
+		value += 0x108
+	default:
+		value = (value + 0x108) << (segment - 1)
+	}
+	if encoded&0x80 != 0 {
+		return int16(value)
+	}
+	return int16(-value)
+}
+
+func TestG711_KnownValues(t *testing.T) {
+	cases := []struct {
+		sample      int16
+		muLaw, aLaw byte
+	}{
+		{0, 0xFF, 0xD5},
+		{math.MaxInt16, 0x80, 0xAA},
+		{math.MinInt16, 0x00, 0x2A},
+		{-1, 0x7F, 0x55},
+	}
+	for _, tc := range cases {
+		if got := linearToMuLaw(tc.sample); got != tc.muLaw {
+			t.Fatalf("mu-law of %d: expected 0x%02X, got 0x%02X", tc.sample, tc.muLaw, got)
+		}
+		if got := linearToALaw(tc.sample); got != tc.aLaw {
+			t.Fatalf("A-law of %d: expected 0x%02X, got 0x%02X", tc.sample, tc.aLaw, got)
+		}
+	}
+}
+
+func TestG711_RoundTrip(t *testing.T) {
+	for sample := math.MinInt16; sample <= math.MaxInt16; sample++ {
+		// Quantization steps grow with the magnitude, up to 1/16th of it
+		tolerance := math.Max(math.Abs(float64(sample))/16, 16)
+		if decoded := muLawToLinear(linearToMuLaw(int16(sample))); math.Abs(float64(decoded)-float64(sample)) > tolerance+8 {
+			t.Fatalf("mu-law of %d decodes to %d", sample, decoded)
+		}
+		if decoded := aLawToLinear(linearToALaw(int16(sample))); math.Abs(float64(decoded)-float64(sample)) > tolerance {
+			t.Fatalf("A-law of %d decodes to %d", sample, decoded)
+		}
+	}
+}
+
+func TestNewG711Encoder_ResamplesTo8kHz(t *testing.T) {
+	input := sineSamples(22050, 22050, 440, 10000)
+	encoded, err := io.ReadAll(newG711Encoder(bytes.NewReader(pcmBytes(input)), 22050, g711Formats["alaw"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) != g711SampleRate {
+		t.Fatalf("expected %d bytes, got %d", g711SampleRate, len(encoded))
+	}
+	expected := sineSamples(g711SampleRate, g711SampleRate, 440, 10000)
+	for i := 400; i < len(encoded)-400; i++ {
+		if math.Abs(float64(aLawToLinear(encoded[i]))-float64(expected[i])) > 400 {
+			t.Fatalf("sample %d decodes to %d, expected %d", i, aLawToLinear(encoded[i]), expected[i])
+		}
+	}
+}
@@ -27,3 +27,7 @@ func newTestContext(method, path, body string) (*gin.Context, *httptest.Response
 	c.Request = req
 	return c, w
 }
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
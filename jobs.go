@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+const jobCallbackTimeout = 10 * time.Second
+
+var (
+	errJobQueueFull          = errors.New("job queue is full")
+	errJobCallbackNotAllowed = errors.New("callback host is not allowed")
+)
+
+// TTSJobRequest is the body of POST /api/jobs.
+type TTSJobRequest struct {
+	TTSRequestInput
+	CallbackURL string `json:"callbackUrl"`
+}
+
+// TTSJob is a synthesis request processed in the background. Finished jobs
+// and their audio are kept until Expires.
+type TTSJob struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Progress    float64    `json:"progress"`
+	Error       string     `json:"error,omitempty"`
+	AudioURL    string     `json:"audioUrl,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	Expires     *time.Time `json:"expiresAt,omitempty"`
+
+	callbackURL string
+	plan        ttsPlan
+}
+
+type TTSJobsStore struct {
+	mu         sync.RWMutex
+	jobs       map[string]*TTSJob
+	queue      chan string
+	dir        string
+	expiration time.Duration
+	pool       *PiperPool
+	// client only connects to public addresses, trustedClient is used for
+	// the hosts of JOB_CALLBACK_ALLOWED_HOSTS
+	client        *http.Client
+	trustedClient *http.Client
+}
+
+// newTTSJobsStore returns a store writing job audio to dir. Jobs are only
+// kept in memory, so the files left in dir by a previous run are deleted.
+func newTTSJobsStore(dir string, queueSize int, expiration time.Duration, pool *PiperPool) (*TTSJobsStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			os.Remove(filepath.Join(dir, file.Name()))
+		}
+	}
+	return &TTSJobsStore{
+		jobs:          make(map[string]*TTSJob),
+		queue:         make(chan string, queueSize),
+		dir:           dir,
+		expiration:    expiration,
+		pool:          pool,
+		client:        newJobCallbackClient(true),
+		trustedClient: newJobCallbackClient(false),
+	}, nil
+}
+
+// newJobCallbackClient returns the client sending callbacks, refusing to
+// connect to loopback, private and link-local addresses when publicOnly is
+// set. The address is checked once resolved, so a public host name resolving
+// to a private address is refused too. Redirects aren't followed.
+func newJobCallbackClient(publicOnly bool) *http.Client {
+	dialer := &net.Dialer{Timeout: jobCallbackTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if publicOnly {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errJobCallbackNotAllowed
+			}
+			return nil
+		}
+		// Connecting through a proxy would bypass the check
+		transport.Proxy = nil
+	}
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   jobCallbackTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// jobCallbackHostTrusted reports whether host is listed in
+// JOB_CALLBACK_ALLOWED_HOSTS, allowing callbacks to private addresses.
+func jobCallbackHostTrusted(host string) bool {
+	for _, allowed := range JOB_CALLBACK_ALLOWED_HOSTS {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateJobCallbackURL checks the callback URL of a job request. Host names
+// are only checked once resolved, when sending the callback.
+func validateJobCallbackURL(callbackURL string) error {
+	callback, err := url.Parse(callbackURL)
+	if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") || callback.Host == "" {
+		return errors.New("invalid callbackUrl, must be an http or https URL")
+	}
+	if jobCallbackHostTrusted(callback.Hostname()) {
+		return nil
+	}
+	if ip := net.ParseIP(callback.Hostname()); ip != nil && !isPublicIP(ip) {
+		return errors.New("invalid callbackUrl, private and loopback addresses are not allowed")
+	}
+	return nil
+}
+
+func initTTSJobsStore(pool *PiperPool) *TTSJobsStore {
+	s, err := newTTSJobsStore(JOBS_PATH, JOB_QUEUE_SIZE, time.Duration(JOB_EXPIRATION_MINUTES)*time.Minute, pool)
+	if err != nil {
+		log.Fatalf("Failed to initialize jobs store: %v", err)
+	}
+	if JOB_CALLBACK_SECRET == "" {
+		log.Println("Warning: JOB_CALLBACK_SECRET is not set, job callbacks are sent unsigned and receivers can't verify them")
+	}
+	for i := 0; i < JOB_WORKERS; i++ {
+		go s.work()
+	}
+	go func() {
+		for {
+			s.expireOld()
+			time.Sleep(time.Minute)
+		}
+	}()
+	return s
+}
+
+// submit queues a planned request, failing with errJobQueueFull instead of
+// waiting when the queue is at capacity.
+func (s *TTSJobsStore) submit(plan ttsPlan, callbackURL string) (TTSJob, error) {
+	job := &TTSJob{
+		ID:          uuid.New().String(),
+		Status:      JobQueued,
+		CreatedAt:   time.Now(),
+		callbackURL: callbackURL,
+		plan:        plan,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.queue <- job.ID:
+	default:
+		return TTSJob{}, errJobQueueFull
+	}
+	s.jobs[job.ID] = job
+	return *job, nil
+}
+
+func (s *TTSJobsStore) get(id string) (TTSJob, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return TTSJob{}, false
+	}
+	return *job, true
+}
+
+func (s *TTSJobsStore) update(id string, f func(job *TTSJob)) TTSJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.jobs[id]
+	f(job)
+	return *job
+}
+
+func (s *TTSJobsStore) audioPath(job TTSJob) string {
+	return filepath.Join(s.dir, job.ID+"."+job.plan.OutputFormat)
+}
+
+// expireOld forgets finished jobs past their expiration and deletes their audio.
+func (s *TTSJobsStore) expireOld() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, job := range s.jobs {
+		if job.Expires != nil && job.Expires.Before(now) {
+			os.Remove(s.audioPath(*job))
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (s *TTSJobsStore) work() {
+	for id := range s.queue {
+		s.run(id)
+	}
+}
+
+func (s *TTSJobsStore) run(id string) {
+	job := s.update(id, func(job *TTSJob) { job.Status = JobRunning })
+
+	err := s.synthesize(job)
+
+	job = s.update(id, func(job *TTSJob) {
+		completedAt := time.Now()
+		expires := completedAt.Add(s.expiration)
+		job.CompletedAt = &completedAt
+		job.Expires = &expires
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+			return
+		}
+		job.Status = JobCompleted
+		job.Progress = 1
+		job.AudioURL = "/api/jobs/" + job.ID + "/audio"
+	})
+	if err != nil {
+		log.Printf("Job %s failed: %v", id, err)
+	}
+	if job.callbackURL != "" {
+		if err := s.notify(job); err != nil {
+			log.Printf("Job %s callback failed: %v", id, err)
+		}
+	}
+}
+
+// synthesize writes the audio of a job to its file, updating the job
+// progress as sentences complete.
+func (s *TTSJobsStore) synthesize(job TTSJob) error {
+	file, err := os.CreateTemp(s.dir, ".tmp-"+job.ID)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	audio := newSegmentStream(context.Background(), s.pool, job.plan.Segments, job.plan.SampleRate)
+	defer audio.Close()
+	total := countSentences(job.plan.Segments)
+	done := 0
+	audio.onSentence = func() {
+		done++
+		if total > 0 {
+			s.update(job.ID, func(job *TTSJob) { job.Progress = float64(done) / float64(total) })
+		}
+	}
+
+	if err := writeAudioFile(s.pool, file, audio, job.plan); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.audioPath(job))
+}
+
+// writeAudioFile encodes the raw audio of a plan to file in its output
+// format. Unlike streamed audio, headers are completed with the actual sizes.
+func writeAudioFile(pool *PiperPool, file *os.File, audio io.Reader, plan ttsPlan) error {
+	if _, ok := ffmpegFormats[plan.OutputFormat]; ok {
+		return encodeWithFfmpeg(pool, newResampler(audio, plan.SampleRate, plan.Output.SampleRate), file, plan.OutputFormat, plan.Output.SampleRate)
+	}
+	if plan.OutputFormat == "flac" {
+		return writeFLACFile(file, newResampler(audio, plan.SampleRate, plan.Output.SampleRate), plan.Output.SampleRate)
+	}
+	if format, ok := g711Formats[plan.OutputFormat]; ok {
+		return writeG711File(file, audio, plan.SampleRate, format)
+	}
+	return writeWAVFile(file, convertPCM(audio, plan.SampleRate, plan.Output), plan.Output)
+}
+
+func writeWAVFile(file *os.File, audio io.Reader, format pcmFormat) error {
+	header := generatePCMWAVHeader(format)
+	if _, err := file.Write(header); err != nil {
+		return err
+	}
+	size, err := io.Copy(file, audio)
+	if err != nil {
+		return err
+	}
+	return setWAVDataSize(file, header, size)
+}
+
+func writeFLACFile(file *os.File, audio io.Reader, sampleRate int) error {
+	encoder, err := newFLACEncoder(file, sampleRate)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encoder, audio); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return setFLACStreamInfo(file, encoder)
+}
+
+func writeG711File(file *os.File, audio io.Reader, sampleRate int, format g711Format) error {
+	if format.WAVFormat == 0 {
+		_, err := io.Copy(file, newG711Encoder(audio, sampleRate, format))
+		return err
+	}
+	header := generateWAVFormatHeader(format.WAVFormat, g711SampleRate, 1, 8)
+	if _, err := file.Write(header); err != nil {
+		return err
+	}
+	size, err := io.Copy(file, newG711Encoder(audio, sampleRate, format))
+	if err != nil {
+		return err
+	}
+	return setWAVDataSize(file, header, size)
+}
+
+func signJobCallback(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify POSTs the finished job to its callback URL, signing the body with
+// JOB_CALLBACK_SECRET when set. Only the hosts of JOB_CALLBACK_ALLOWED_HOSTS
+// may have private addresses.
+func (s *TTSJobsStore) notify(job TTSJob) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", job.callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if JOB_CALLBACK_SECRET != "" {
+		req.Header.Set("X-Signature", signJobCallback(body, JOB_CALLBACK_SECRET))
+	}
+	client := s.client
+	if jobCallbackHostTrusted(req.URL.Hostname()) {
+		client = s.trustedClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func jobsPostHandler(catalog *VoiceCatalog, s *TTSJobsStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		voices := catalog.get()
+		var req TTSJobRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.String(http.StatusBadRequest, "Invalid request")
+			return
+		}
+		if req.CallbackURL != "" {
+			if err := validateJobCallbackURL(req.CallbackURL); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		ttsRequestInput := applyTTSRequestDefaults(c, req.TTSRequestInput)
+		plan, err := planTTS(ttsRequestInput, voices)
+		if err != nil {
+			writeTTSPlanError(c, err)
+			return
+		}
+		if logInput {
+			fmt.Println(strconv.Quote(ttsRequestInput.Text))
+		}
+
+		job, err := s.submit(plan, req.CallbackURL)
+		if err != nil {
+			c.String(http.StatusServiceUnavailable, "Job queue is full, try again later")
+			return
+		}
+		c.JSON(http.StatusAccepted, job)
+	}
+}
+
+func jobsGetHandler(s *TTSJobsStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, ok := s.get(c.Param("jobId"))
+		if !ok {
+			c.String(http.StatusNotFound, "Job not found")
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+func jobsAudioHandler(s *TTSJobsStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, ok := s.get(c.Param("jobId"))
+		if !ok {
+			c.String(http.StatusNotFound, "Job not found")
+			return
+		}
+		if job.Status != JobCompleted {
+			c.String(http.StatusConflict, "Job is "+job.Status)
+			return
+		}
+		file, err := os.Open(s.audioPath(job))
+		if err != nil {
+			c.String(http.StatusNotFound, "Job audio not found")
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Error reading job audio")
+			return
+		}
+		c.Header("Content-Type", outputContentTypes[job.plan.OutputFormat])
+		http.ServeContent(c.Writer, c.Request, filepath.Base(file.Name()), info.ModTime(), file)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func waitForJob(t *testing.T, s *TTSJobsStore, id string) TTSJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := s.get(id)
+		if !ok {
+			t.Fatalf("job %s not found", id)
+		}
+		if job.Status == JobCompleted || job.Status == JobFailed {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return TTSJob{}
+}
+
+func newTestJobsStore(t *testing.T, queueSize int, pool *PiperPool) *TTSJobsStore {
+	t.Helper()
+	s, err := newTTSJobsStore(t.TempDir(), queueSize, time.Minute, pool)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s
+}
+
+func TestNewTTSJobsStore_RemovesLeftoverFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"0c9f7a6e.wav", ".tmp-0c9f7a6e123"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("audio"), 0644)
+	}
+	if _, err := newTTSJobsStore(dir, 1, time.Minute, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected leftover files to be removed, got %v", files)
+	}
+}
+
+func TestJobsPostHandler_MissingText(t *testing.T) {
+	voices := Voices{}
+	s := newTestJobsStore(t, 1, nil)
+	c, w := newTestContext("POST", "/api/jobs", `{"voice":"en_US-amy-low"}`)
+	jobsPostHandler(newVoiceCatalog(voices), s)(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestJobsPostHandler_InvalidCallbackURL(t *testing.T) {
+	voices := Voices{}
+	s := newTestJobsStore(t, 1, nil)
+	c, w := newTestContext("POST", "/api/jobs", `{"text":"hello","callbackUrl":"ftp://example.com"}`)
+	jobsPostHandler(newVoiceCatalog(voices), s)(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestJobsPostHandler_QueueFull(t *testing.T) {
+	voices := Voices{}
+	voiceRegistry.set("test-jobs-voice", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	defer voiceRegistry.remove("test-jobs-voice")
+	s := newTestJobsStore(t, 1, nil)
+	body := `{"text":"hello","voice":"test-jobs-voice"}`
+
+	c, w := newTestContext("POST", "/api/jobs", body)
+	jobsPostHandler(newVoiceCatalog(voices), s)(c)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	var job TTSJob
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatalf("response is not valid JSON: %v", err)
+	}
+	if job.ID == "" || job.Status != JobQueued {
+		t.Fatalf("expected a queued job, got %+v", job)
+	}
+
+	c, w = newTestContext("POST", "/api/jobs", body)
+	jobsPostHandler(newVoiceCatalog(voices), s)(c)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+}
+
+func TestJobsAudioHandler_NotFinished(t *testing.T) {
+	s := newTestJobsStore(t, 1, nil)
+	job, err := s.submit(ttsPlan{OutputFormat: "wav"}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c, w := newTestContext("GET", "/api/jobs/"+job.ID+"/audio", "")
+	c.Params = gin.Params{{Key: "jobId", Value: job.ID}}
+	jobsAudioHandler(s)(c)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", w.Code)
+	}
+}
+
+func TestJobsGetHandler_NotFound(t *testing.T) {
+	s := newTestJobsStore(t, 1, nil)
+	c, w := newTestContext("GET", "/api/jobs/missing", "")
+	c.Params = gin.Params{{Key: "jobId", Value: "missing"}}
+	jobsGetHandler(s)(c)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestJobsPostHandler_PrivateCallbackURL(t *testing.T) {
+	voices := Voices{}
+	s := newTestJobsStore(t, 1, nil)
+	for _, callbackURL := range []string{"http://127.0.0.1:8080/hook", "http://10.0.0.5/hook", "http://[::1]/hook", "http://169.254.169.254/latest"} {
+		c, w := newTestContext("POST", "/api/jobs", `{"text":"hello","callbackUrl":"`+callbackURL+`"}`)
+		jobsPostHandler(newVoiceCatalog(voices), s)(c)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", callbackURL, w.Code)
+		}
+	}
+}
+
+func useJobCallbackAllowedHosts(t *testing.T, hosts ...string) {
+	t.Helper()
+	previous := JOB_CALLBACK_ALLOWED_HOSTS
+	JOB_CALLBACK_ALLOWED_HOSTS = hosts
+	t.Cleanup(func() { JOB_CALLBACK_ALLOWED_HOSTS = previous })
+}
+
+func TestTTSJobsStore_NotifyRefusesPrivateAddresses(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	s := newTestJobsStore(t, 1, nil)
+	// A host name resolving to a loopback address is refused once resolved
+	callbackURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	err := s.notify(TTSJob{ID: "job", Status: JobCompleted, callbackURL: callbackURL})
+	if err == nil || !strings.Contains(err.Error(), errJobCallbackNotAllowed.Error()) {
+		t.Fatalf("expected callback to be refused, got %v", err)
+	}
+	if called {
+		t.Fatal("expected the callback not to reach the server")
+	}
+
+	useJobCallbackAllowedHosts(t, "localhost")
+	if err := s.notify(TTSJob{ID: "job", Status: JobCompleted, callbackURL: callbackURL}); err != nil {
+		t.Fatalf("expected allowed host to be called back, got %v", err)
+	}
+}
+
+func TestTTSJobsStore_RunCompletesAndCallsBack(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+	previousSecret := JOB_CALLBACK_SECRET
+	JOB_CALLBACK_SECRET = "secret"
+	defer func() { JOB_CALLBACK_SECRET = previousSecret }()
+	useJobCallbackAllowedHosts(t, "127.0.0.1")
+
+	callbacks := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		callbacks <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	s := newTestJobsStore(t, 1, pool)
+	plan := ttsPlan{
+		Segments:     []ttsSegment{{Config: piperConfig{Voice: "test-jobs-voice"}, Text: "Hello. World."}},
+		SampleRate:   16000,
+		OutputFormat: "wav",
+		Output:       pcmFormat{SampleRate: 16000, Channels: 1, BitsPerSample: 16},
+	}
+	job, err := s.submit(plan, server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go s.work()
+	defer close(s.queue)
+
+	job = waitForJob(t, s, job.ID)
+	if job.Status != JobCompleted || job.Progress != 1 {
+		t.Fatalf("expected completed job, got %+v", job)
+	}
+
+	data, err := os.ReadFile(s.audioPath(job))
+	if err != nil {
+		t.Fatalf("expected job audio: %v", err)
+	}
+	pcm := `audio:{"text":"Hello."}audio:{"text":"World."}`
+	if string(data[44:]) != pcm {
+		t.Fatalf("unexpected audio %q", data[44:])
+	}
+	if size := binary.LittleEndian.Uint32(data[40:44]); size != uint32(len(pcm)) {
+		t.Fatalf("expected data size %d, got %d", len(pcm), size)
+	}
+
+	select {
+	case r := <-callbacks:
+		body := <-bodies
+		if got := r.Header.Get("X-Signature"); got != signJobCallback(body, "secret") {
+			t.Fatalf("unexpected signature %q", got)
+		}
+		var payload TTSJob
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatalf("callback body is not valid JSON: %v", err)
+		}
+		if payload.ID != job.ID || payload.Status != JobCompleted {
+			t.Fatalf("unexpected callback payload %+v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected callback")
+	}
+}
+
+func TestTTSJobsStore_ExpireOldRemovesAudio(t *testing.T) {
+	s := newTestJobsStore(t, 1, nil)
+	job, _ := s.submit(ttsPlan{OutputFormat: "wav"}, "")
+	path := s.audioPath(job)
+	os.WriteFile(path, []byte("audio"), 0644)
+	expired := time.Now().Add(-time.Second)
+	s.update(job.ID, func(job *TTSJob) {
+		job.Status = JobCompleted
+		job.Expires = &expired
+	})
+
+	s.expireOld()
+	if _, ok := s.get(job.ID); ok {
+		t.Fatal("expected expired job to be removed")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("expected expired job audio to be deleted")
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
@@ -16,7 +16,6 @@ import (
 
 func main() {
 	port := getEnv("PORT", "8080")
-	preloadVoices := getEnv("PRELOAD_VOICES", "")
 
 	debug := os.Getenv("DEBUG")
 	if debug == "1" || debug == "true" {
@@ -25,10 +24,25 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	voices := getAvailableVoices(VOICES_JSON_PATH)
+	catalog := initVoiceCatalog()
 	loadVoicesDetails()
-	ensureVoices(strings.Split(preloadVoices, ","), &voices)
+	loadCustomVoices(catalog)
+	watchVoicesPath(catalog)
+	ensureVoices(PRELOAD_VOICES, catalog.get())
 	requestsMap := initTTSRequestsStore()
+	pool := initPiperPool()
+	voiceRegistry.onEvict = pool.discardVoice
+	cache := initAudioCache()
+	jobs := initTTSJobsStore(pool)
+	for _, voiceName := range PRELOAD_VOICES {
+		details, ok := voiceRegistry.get(voiceName)
+		if !ok {
+			continue
+		}
+		if err := pool.warm(applyInferenceDefaults(piperConfig{Voice: voiceName, LengthScale: 1.0}, inferenceParameters{}, details)); err != nil {
+			log.Printf("Failed to warm piper workers for %s: %v", voiceName, err)
+		}
+	}
 
 	r := gin.New()
 	r.Use(gin.Recovery())
@@ -39,11 +53,23 @@ func main() {
 	})
 	r.Use(gin.Logger())
 	r.GET("/", homeHandler)
-	r.GET("/api/voices", voicesHandler(&voices))
-	r.POST("/api/tts", ttsHandler(&voices))
-	r.GET("/api/tts", ttsHandler(&voices))
+	r.GET("/api/presets", presetsHandler)
+	r.GET("/api/voices", voicesHandler(catalog))
+	r.POST("/api/voices/refresh", voicesRefreshHandler(catalog))
+	r.POST("/api/voices/custom", customVoiceUploadHandler(catalog))
+	r.GET("/api/voices/:key", voiceStatusHandler(catalog))
+	r.DELETE("/api/voices/:key", voiceDeleteHandler(catalog))
+	r.GET("/api/voices/:key/speakers", voiceSpeakersHandler(catalog))
+	r.POST("/api/voices/:key/download", voiceDownloadHandler(catalog))
+	r.GET("/api/voices/:key/download/events", voiceDownloadEventsHandler(catalog))
+	r.POST("/api/tts", ttsHandler(catalog, pool, cache))
+	r.GET("/api/tts", ttsHandler(catalog, pool, cache))
 	r.POST("/api/tts/stream", ttsPostStreamHandler(requestsMap))
-	r.GET("/api/tts/stream/:streamId", ttsGetStreamHandler(&voices, requestsMap))
+	r.GET("/api/tts/stream/:streamId", ttsGetStreamHandler(catalog, requestsMap, pool, cache))
+	r.POST("/api/jobs", jobsPostHandler(catalog, jobs))
+	r.GET("/api/jobs/:jobId", jobsGetHandler(jobs))
+	r.GET("/api/jobs/:jobId/audio", jobsAudioHandler(jobs))
+	r.POST("/v1/audio/speech", openAISpeechHandler(catalog, pool, cache))
 
 	srv := &http.Server{
 		Addr:    ":" + port,
@@ -57,6 +83,17 @@ func main() {
 		}
 	}()
 
+	var wyomingListener net.Listener
+	if WYOMING_PORT != "" {
+		var err error
+		wyomingListener, err = net.Listen("tcp", ":"+WYOMING_PORT)
+		if err != nil {
+			log.Fatalf("Failed to start wyoming server: %v", err)
+		}
+		fmt.Printf("Listening and serving Wyoming on :%s\n", WYOMING_PORT)
+		go serveWyoming(wyomingListener, catalog, pool)
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -68,7 +105,10 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
+	if wyomingListener != nil {
+		wyomingListener.Close()
+	}
 
-	killAllProcesses()
+	pool.close()
 	log.Println("Server exited")
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAISpeechRequest mirrors the body of OpenAI's POST /v1/audio/speech.
+type OpenAISpeechRequest struct {
+	Model          string  `json:"model"`
+	Input          string  `json:"input"`
+	Voice          string  `json:"voice"`
+	ResponseFormat string  `json:"response_format"`
+	Speed          float64 `json:"speed"`
+}
+
+const openAIMaxInputLength = 4096
+
+func openAIError(c *gin.Context, status int, message string, param string) {
+	var errParam interface{}
+	if param != "" {
+		errParam = param
+	}
+	c.JSON(status, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    "invalid_request_error",
+			"param":   errParam,
+			"code":    nil,
+		},
+	})
+}
+
+// resolveOpenAIVoice maps an OpenAI voice name to a piper voice. Piper voice
+// keys are accepted as-is so clients can pick any installed voice.
+func resolveOpenAIVoice(voice string) string {
+	if piperVoice, ok := OPENAI_VOICE_MAP[voice]; ok {
+		return piperVoice
+	}
+	return voice
+}
+
+func openAISpeechHandler(catalog *VoiceCatalog, pool *PiperPool, cache *AudioCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		voices := catalog.get()
+		var req OpenAISpeechRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			openAIError(c, http.StatusBadRequest, "Invalid request, JSON body required", "")
+			return
+		}
+
+		if req.Input == "" {
+			openAIError(c, http.StatusBadRequest, "Missing required parameter: 'input'.", "input")
+			return
+		}
+		if utf8.RuneCountInString(req.Input) > openAIMaxInputLength {
+			openAIError(c, http.StatusBadRequest, "Input is longer than 4096 characters.", "input")
+			return
+		}
+		if req.Voice == "" {
+			openAIError(c, http.StatusBadRequest, "Missing required parameter: 'voice'.", "voice")
+			return
+		}
+		if req.ResponseFormat == "" {
+			req.ResponseFormat = "mp3"
+		}
+		if req.ResponseFormat == "pcm" {
+			openAIError(c, http.StatusBadRequest, "response_format 'pcm' is not supported, use 'wav' for uncompressed audio.", "response_format")
+			return
+		}
+		if _, ok := outputContentTypes[req.ResponseFormat]; !ok {
+			formats := slices.Sorted(maps.Keys(outputContentTypes))
+			openAIError(c, http.StatusBadRequest, "Unsupported response_format '"+req.ResponseFormat+"', must be one of "+strings.Join(formats, ", ")+".", "response_format")
+			return
+		}
+		if req.Speed == 0 {
+			req.Speed = 1.0
+		}
+		if req.Speed < 0.25 || req.Speed > 4.0 {
+			openAIError(c, http.StatusBadRequest, "Speed must be between 0.25 and 4.0.", "speed")
+			return
+		}
+
+		voice, err := resolveVoiceName(voices, resolveOpenAIVoice(req.Voice))
+		if notFoundErr, ok := err.(*VoiceNotFoundError); ok {
+			message := "Voice '" + req.Voice + "' not found."
+			if len(notFoundErr.Suggestions) > 0 {
+				message += " Did you mean " + strings.Join(notFoundErr.Suggestions, ", ") + "?"
+			}
+			openAIError(c, http.StatusBadRequest, message, "voice")
+			return
+		}
+		if _, err := getVoiceDetails(voices, voice); err == errVoiceNotInstalled || err == errVoicesQuotaExceeded {
+			openAIError(c, voiceErrorStatus(err, http.StatusBadRequest), "Voice '"+req.Voice+"' is not available: "+err.Error()+".", "voice")
+			return
+		} else if err != nil {
+			openAIError(c, http.StatusBadRequest, "Voice '"+req.Voice+"' not found.", "voice")
+			return
+		}
+
+		cachedAudioStream(c, TTSRequestInput{
+			Text:         req.Input,
+			Voice:        voice,
+			Speed:        req.Speed,
+			OutputFormat: req.ResponseFormat,
+		}, voices, pool, cache)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func decodeOpenAIError(t *testing.T, body []byte) map[string]interface{} {
+	t.Helper()
+	var result struct {
+		Error map[string]interface{} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("response is not valid JSON: %v", err)
+	}
+	if result.Error == nil {
+		t.Fatalf("expected error object, got %s", body)
+	}
+	return result.Error
+}
+
+func TestResolveOpenAIVoice_MapsKnownVoice(t *testing.T) {
+	previous := OPENAI_VOICE_MAP
+	OPENAI_VOICE_MAP = map[string]string{"alloy": "en_US-amy-low"}
+	defer func() { OPENAI_VOICE_MAP = previous }()
+
+	if got := resolveOpenAIVoice("alloy"); got != "en_US-amy-low" {
+		t.Fatalf("expected 'en_US-amy-low', got %q", got)
+	}
+}
+
+func TestResolveOpenAIVoice_PassesThroughPiperVoice(t *testing.T) {
+	if got := resolveOpenAIVoice("en_GB-alan-low"); got != "en_GB-alan-low" {
+		t.Fatalf("expected piper voice to pass through, got %q", got)
+	}
+}
+
+func TestOpenAISpeechHandler_InvalidJSON(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("POST", "/v1/audio/speech", "{not valid json")
+	openAISpeechHandler(newVoiceCatalog(voices), nil, nil)(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if e := decodeOpenAIError(t, w.Body.Bytes()); e["type"] != "invalid_request_error" {
+		t.Fatalf("expected invalid_request_error, got %v", e["type"])
+	}
+}
+
+func TestOpenAISpeechHandler_MissingInput(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("POST", "/v1/audio/speech", `{"model":"tts-1","voice":"alloy"}`)
+	openAISpeechHandler(newVoiceCatalog(voices), nil, nil)(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if e := decodeOpenAIError(t, w.Body.Bytes()); e["param"] != "input" {
+		t.Fatalf("expected param 'input', got %v", e["param"])
+	}
+}
+
+func TestOpenAISpeechHandler_UnsupportedFormat(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("POST", "/v1/audio/speech", `{"model":"tts-1","input":"hello","voice":"alloy","response_format":"aac"}`)
+	openAISpeechHandler(newVoiceCatalog(voices), nil, nil)(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if e := decodeOpenAIError(t, w.Body.Bytes()); e["param"] != "response_format" {
+		t.Fatalf("expected param 'response_format', got %v", e["param"])
+	}
+}
+
+func TestOpenAISpeechHandler_PCMNotSupported(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("POST", "/v1/audio/speech", `{"model":"tts-1","input":"hello","voice":"alloy","response_format":"pcm"}`)
+	openAISpeechHandler(newVoiceCatalog(voices), nil, nil)(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if e := decodeOpenAIError(t, w.Body.Bytes()); !strings.Contains(e["message"].(string), "'pcm' is not supported") {
+		t.Fatalf("expected pcm to be reported as not supported, got %v", e["message"])
+	}
+}
+
+func TestOpenAISpeechHandler_AcceptsFLAC(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("POST", "/v1/audio/speech", `{"model":"tts-1","input":"hello","voice":"unknown-voice","response_format":"flac"}`)
+	openAISpeechHandler(newVoiceCatalog(voices), nil, nil)(c)
+	if e := decodeOpenAIError(t, w.Body.Bytes()); e["param"] != "voice" {
+		t.Fatalf("expected flac to pass validation up to the voice, got error on %v", e["param"])
+	}
+}
+
+func TestOpenAISpeechHandler_SpeedOutOfRange(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("POST", "/v1/audio/speech", `{"model":"tts-1","input":"hello","voice":"alloy","speed":5}`)
+	openAISpeechHandler(newVoiceCatalog(voices), nil, nil)(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if e := decodeOpenAIError(t, w.Body.Bytes()); e["param"] != "speed" {
+		t.Fatalf("expected param 'speed', got %v", e["param"])
+	}
+}
+
+func TestOpenAISpeechHandler_VoiceNotFound(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("POST", "/v1/audio/speech", `{"model":"tts-1","input":"hello","voice":"does-not-exist"}`)
+	openAISpeechHandler(newVoiceCatalog(voices), nil, nil)(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if e := decodeOpenAIError(t, w.Body.Bytes()); e["param"] != "voice" {
+		t.Fatalf("expected param 'voice', got %v", e["param"])
+	}
+}
+
+func TestOpenAISpeechHandler_InputLengthCountsCharacters(t *testing.T) {
+	voices := Voices{}
+	// 4096 two byte characters are within the limit
+	body, _ := json.Marshal(OpenAISpeechRequest{Model: "tts-1", Input: strings.Repeat("é", openAIMaxInputLength), Voice: "does-not-exist"})
+	c, w := newTestContext("POST", "/v1/audio/speech", string(body))
+	openAISpeechHandler(newVoiceCatalog(voices), nil, nil)(c)
+	if e := decodeOpenAIError(t, w.Body.Bytes()); e["param"] != "voice" {
+		t.Fatalf("expected the input to be accepted, got %v", e)
+	}
+
+	body, _ = json.Marshal(OpenAISpeechRequest{Model: "tts-1", Input: strings.Repeat("é", openAIMaxInputLength+1), Voice: "does-not-exist"})
+	c, w = newTestContext("POST", "/v1/audio/speech", string(body))
+	openAISpeechHandler(newVoiceCatalog(voices), nil, nil)(c)
+	if e := decodeOpenAIError(t, w.Body.Bytes()); e["param"] != "input" {
+		t.Fatalf("expected the input to be rejected, got %v", e)
+	}
+}
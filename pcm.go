@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// pcmReadSize is how much of its source a PCM reader reads at once.
+const pcmReadSize = 4096
+
+// pcmFormat is the PCM audio a request asks for, piper always outputting mono
+// 16 bit samples at the sample rate of the voice.
+type pcmFormat struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+}
+
+// convertPCM returns a reader of piper's raw audio at sampleRate converted to
+// format. Mono is upmixed by repeating each sample on every channel, 8 bit
+// samples are unsigned and 32 bit samples are floats, as in WAV files.
+func convertPCM(audio io.Reader, sampleRate int, format pcmFormat) io.Reader {
+	audio = newResampler(audio, sampleRate, format.SampleRate)
+	if format.Channels == 1 && format.BitsPerSample == 16 {
+		return audio
+	}
+	return newPCMConvertReader(audio, func(out []byte, sample int16) []byte {
+		for i := 0; i < format.Channels; i++ {
+			out = appendPCMSample(out, sample, format.BitsPerSample)
+		}
+		return out
+	})
+}
+
+func appendPCMSample(out []byte, sample int16, bitsPerSample int) []byte {
+	switch bitsPerSample {
+	case 8:
+		return append(out, byte(int(sample)>>8+128))
+	case 24:
+		return append(out, 0, byte(sample), byte(sample>>8))
+	case 32:
+		return binary.LittleEndian.AppendUint32(out, math.Float32bits(float32(sample)/32768))
+	}
+	return binary.LittleEndian.AppendUint16(out, uint16(sample))
+}
+
+// pcmConvertReader converts the mono 16 bit little endian samples read from
+// source, convert appending the encoding of each sample to its output.
+type pcmConvertReader struct {
+	source  io.Reader
+	convert func(out []byte, sample int16) []byte
+	in      []byte
+	out     []byte
+	err     error
+}
+
+func newPCMConvertReader(source io.Reader, convert func([]byte, int16) []byte) *pcmConvertReader {
+	return &pcmConvertReader{source: source, convert: convert, in: make([]byte, 0, pcmReadSize)}
+}
+
+func (r *pcmConvertReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.source.Read(r.in[len(r.in):cap(r.in)])
+		r.in = r.in[:len(r.in)+n]
+		r.err = err
+		samples := len(r.in) / 2
+		for i := 0; i < samples; i++ {
+			r.out = r.convert(r.out, int16(binary.LittleEndian.Uint16(r.in[2*i:])))
+		}
+		// Keeps an odd byte for the next read
+		r.in = r.in[:copy(r.in, r.in[2*samples:])]
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// Zero crossings of the resampling filter on each side of a sample, at the
+// lower of the two sample rates.
+const resamplerZeroCrossings = 16
+
+// resampler converts mono 16 bit little endian PCM read from source between
+// sample rates with a polyphase windowed-sinc filter. It only keeps the input
+// samples the filter needs, so it can sit in front of a live stream.
+type resampler struct {
+	source io.Reader
+	// The output rate is upFactor/downFactor times the input one
+	upFactor   int
+	downFactor int
+	halfTaps   int
+	// filters[phase] weighs input samples base-halfTaps+1 to base+halfTaps
+	// for the output sample at base+phase/upFactor
+	filters [][]float64
+
+	input []float64
+	// Index of input[0], the first samples being zeros before the source
+	start int64
+	// Position of the next output sample
+	base  int64
+	phase int
+
+	// Number of samples read from source, and output, once it ended
+	consumed int64
+	produced int64
+	eof      bool
+
+	in  []byte
+	out []byte
+}
+
+// newResampler returns a reader of source resampled from fromRate to toRate,
+// or source itself when they are the same.
+func newResampler(source io.Reader, fromRate, toRate int) io.Reader {
+	if fromRate == toRate || fromRate <= 0 || toRate <= 0 {
+		return source
+	}
+	g := gcd(fromRate, toRate)
+	r := &resampler{source: source, upFactor: toRate / g, downFactor: fromRate / g}
+
+	// Downsampling lowers the cutoff below the output Nyquist frequency to
+	// avoid aliasing, which widens the filter.
+	cutoff := math.Min(1, float64(toRate)/float64(fromRate))
+	r.halfTaps = int(math.Ceil(resamplerZeroCrossings / cutoff))
+	r.filters = make([][]float64, r.upFactor)
+	for phase := range r.filters {
+		filter := make([]float64, 2*r.halfTaps)
+		var sum float64
+		for j := range filter {
+			x := float64(phase)/float64(r.upFactor) - float64(j-r.halfTaps+1)
+			filter[j] = cutoff * sinc(cutoff*x) * blackmanWindow(x/float64(r.halfTaps))
+			sum += filter[j]
+		}
+		// Unity gain at every phase, so silence and DC stay flat
+		for j := range filter {
+			filter[j] /= sum
+		}
+		r.filters[phase] = filter
+	}
+
+	r.input = make([]float64, r.halfTaps-1)
+	r.start = int64(1 - r.halfTaps)
+	r.in = make([]byte, 0, pcmReadSize)
+	return r
+}
+
+func (r *resampler) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		r.resample()
+		if len(r.out) > 0 {
+			break
+		}
+		if r.eof {
+			return 0, io.EOF
+		}
+		n, err := r.source.Read(r.in[len(r.in):cap(r.in)])
+		r.in = r.in[:len(r.in)+n]
+		samples := len(r.in) / 2
+		for i := 0; i < samples; i++ {
+			r.input = append(r.input, float64(int16(binary.LittleEndian.Uint16(r.in[2*i:]))))
+		}
+		r.consumed += int64(samples)
+		r.in = r.in[:copy(r.in, r.in[2*samples:])]
+		if err == io.EOF {
+			// Pads the end with zeros for the filter of the last samples
+			r.eof = true
+			r.input = append(r.input, make([]float64, r.halfTaps)...)
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// resample outputs every sample whose filter has all its input, and drops the
+// input no longer needed.
+func (r *resampler) resample() {
+	// The output has ceil(consumed * upFactor / downFactor) samples
+	total := (r.consumed*int64(r.upFactor) + int64(r.downFactor) - 1) / int64(r.downFactor)
+	for r.base+int64(r.halfTaps) < r.start+int64(len(r.input)) && (!r.eof || r.produced < total) {
+		window := r.input[r.base-int64(r.halfTaps)+1-r.start:]
+		var value float64
+		for j, weight := range r.filters[r.phase] {
+			value += weight * window[j]
+		}
+		r.out = binary.LittleEndian.AppendUint16(r.out, uint16(clampInt16(value)))
+		r.produced++
+
+		r.phase += r.downFactor
+		r.base += int64(r.phase / r.upFactor)
+		r.phase %= r.upFactor
+	}
+	if drop := r.base - int64(r.halfTaps) + 1 - r.start; drop > 0 && drop <= int64(len(r.input)) {
+		r.input = r.input[:copy(r.input, r.input[drop:])]
+		r.start += drop
+	}
+}
+
+func clampInt16(value float64) int16 {
+	return int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.Round(value))))
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackmanWindow returns the Blackman window at x, which spans -1 to 1.
+func blackmanWindow(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+)
+
+// oneByteReader returns its data one byte at a time, like a slow stream.
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func sineSamples(n, sampleRate int, frequency, amplitude float64) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = int16(amplitude * math.Sin(2*math.Pi*frequency*float64(i)/float64(sampleRate)))
+	}
+	return samples
+}
+
+func readSamples(t *testing.T, r io.Reader) []int16 {
+	t.Helper()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make([]int16, len(data)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+	}
+	return samples
+}
+
+func TestPCMConvertReader_KeepsOddBytes(t *testing.T) {
+	samples := []int16{1, -2, 300, math.MinInt16}
+	r := newPCMConvertReader(&oneByteReader{data: pcmBytes(samples)}, func(out []byte, sample int16) []byte {
+		return binary.LittleEndian.AppendUint16(out, uint16(sample*2))
+	})
+	got := readSamples(t, r)
+	want := []int16{2, -4, 600, 0}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestNewResampler_SameRate(t *testing.T) {
+	source := bytes.NewReader(nil)
+	if newResampler(source, 22050, 22050) != source {
+		t.Fatal("expected source to be returned as is")
+	}
+}
+
+func TestResampler_KeepsTone(t *testing.T) {
+	cases := []struct{ from, to int }{
+		{22050, 8000},
+		{16000, 8000},
+		{16000, 44100},
+		{22050, 48000},
+	}
+	for _, tc := range cases {
+		input := sineSamples(tc.from, tc.from, 440, 10000)
+		output := readSamples(t, newResampler(bytes.NewReader(pcmBytes(input)), tc.from, tc.to))
+		if len(output) != tc.to {
+			t.Fatalf("%d to %d Hz: expected %d samples, got %d", tc.from, tc.to, tc.to, len(output))
+		}
+		expected := sineSamples(tc.to, tc.to, 440, 10000)
+		// The edges are filtered against the silence around the audio
+		for i := tc.to / 20; i < tc.to-tc.to/20; i++ {
+			if math.Abs(float64(output[i])-float64(expected[i])) > 50 {
+				t.Fatalf("%d to %d Hz: sample %d is %d, expected %d", tc.from, tc.to, i, output[i], expected[i])
+			}
+		}
+	}
+}
+
+func TestResampler_FiltersAliases(t *testing.T) {
+	// 6 kHz is above the Nyquist frequency of 8 kHz audio
+	input := sineSamples(22050, 22050, 6000, 10000)
+	output := readSamples(t, newResampler(bytes.NewReader(pcmBytes(input)), 22050, 8000))
+	var energy float64
+	for _, sample := range output[400 : len(output)-400] {
+		energy += float64(sample) * float64(sample)
+	}
+	if rms := math.Sqrt(energy / float64(len(output)-800)); rms > 50 {
+		t.Fatalf("expected the tone to be filtered out, got an RMS of %.1f", rms)
+	}
+}
+
+func TestResampler_StreamsSlowSources(t *testing.T) {
+	input := pcmBytes(sineSamples(3000, 22050, 440, 10000))
+	whole := readSamples(t, newResampler(bytes.NewReader(input), 22050, 8000))
+	slow := readSamples(t, newResampler(&oneByteReader{data: input}, 22050, 8000))
+	if !bytes.Equal(pcmBytes(whole), pcmBytes(slow)) {
+		t.Fatal("expected the output not to depend on how the source is read")
+	}
+}
+
+func TestConvertPCM_ChannelsAndSampleSizes(t *testing.T) {
+	input := pcmBytes([]int16{0, math.MaxInt16, math.MinInt16})
+	cases := []struct {
+		format pcmFormat
+		want   []byte
+	}{
+		{pcmFormat{22050, 1, 16}, input},
+		{pcmFormat{22050, 2, 16}, []byte{0, 0, 0, 0, 0xFF, 0x7F, 0xFF, 0x7F, 0x00, 0x80, 0x00, 0x80}},
+		{pcmFormat{22050, 1, 8}, []byte{0x80, 0xFF, 0x00}},
+		{pcmFormat{22050, 1, 24}, []byte{0, 0, 0, 0, 0xFF, 0x7F, 0, 0x00, 0x80}},
+		{pcmFormat{22050, 1, 32}, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(
+			binary.LittleEndian.AppendUint32(nil, math.Float32bits(0)), math.Float32bits(32767.0/32768)), math.Float32bits(-1))},
+	}
+	for _, tc := range cases {
+		got, err := io.ReadAll(convertPCM(bytes.NewReader(input), 22050, tc.format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Fatalf("%+v: expected %x, got %x", tc.format, tc.want, got)
+		}
+	}
+}
+
+func TestConvertPCM_Resamples(t *testing.T) {
+	input := pcmBytes(sineSamples(16000, 16000, 440, 10000))
+	got, _ := io.ReadAll(convertPCM(bytes.NewReader(input), 16000, pcmFormat{48000, 2, 16}))
+	if len(got) != 48000*2*2 {
+		t.Fatalf("expected a second of 48 kHz stereo audio, got %d bytes", len(got))
+	}
+}
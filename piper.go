@@ -9,36 +9,10 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
-	"sync"
 
 	"github.com/gin-gonic/gin"
 )
 
-var (
-	processMu  sync.Mutex
-	processMap = make(map[int]*os.Process)
-)
-
-func trackProcess(p *os.Process) {
-	processMu.Lock()
-	processMap[p.Pid] = p
-	processMu.Unlock()
-}
-
-func untrackProcess(p *os.Process) {
-	processMu.Lock()
-	delete(processMap, p.Pid)
-	processMu.Unlock()
-}
-
-func killAllProcesses() {
-	processMu.Lock()
-	defer processMu.Unlock()
-	for _, p := range processMap {
-		p.Kill()
-	}
-}
-
 func streamWavData(c *gin.Context, audioData io.Reader) {
 	buffer := make([]byte, 4096)
 	streaming := true
@@ -60,6 +34,7 @@ func streamWavData(c *gin.Context, audioData io.Reader) {
 			if err != nil {
 				if err != io.EOF {
 					log.Printf("error reading audio data: %v", err)
+					c.Error(err)
 				}
 				streaming = false
 				break
@@ -68,6 +43,7 @@ func streamWavData(c *gin.Context, audioData io.Reader) {
 			if n > 0 {
 				if _, err := c.Writer.Write(buffer[:n]); err != nil {
 					log.Printf("error writing to client: %v", err)
+					c.Error(err)
 					streaming = false
 					break
 				}
@@ -88,34 +64,68 @@ func speedToLengthScale(speed float64) float64 {
 	return 1.0 / speed
 }
 
-func buildPiperCmd(voice string, speaker int, lengthScale float64) *exec.Cmd {
+// inferenceParameters are the piper inference parameters a request sets, nil
+// ones taking the default of the voice.
+type inferenceParameters struct {
+	NoiseScale      *float64
+	NoiseW          *float64
+	SentenceSilence *float64
+}
+
+// applyInferenceDefaults sets the inference parameters of config to params,
+// falling back to the defaults of the voice for those params leaves unset.
+func applyInferenceDefaults(config piperConfig, params inferenceParameters, details VoiceDetails) piperConfig {
+	config.NoiseScale = valueOrDefault(params.NoiseScale, details.Inference.NoiseScale)
+	config.NoiseW = valueOrDefault(params.NoiseW, details.Inference.NoiseW)
+	config.SentenceSilence = valueOrDefault(params.SentenceSilence, details.Inference.SentenceSilence)
+	return config
+}
+
+func valueOrDefault(value *float64, defaultValue float64) float64 {
+	if value == nil {
+		return defaultValue
+	}
+	return *value
+}
+
+func formatPiperFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func buildPiperCmd(config piperConfig) *exec.Cmd {
 	cmdArgs := []string{
 		PIPER_BINARY,
-		"--model", fmt.Sprintf("%s/%s.onnx", VOICES_PATH, voice),
-		"--config", fmt.Sprintf("%s/%s.onnx.json", VOICES_PATH, voice),
+		"--model", fmt.Sprintf("%s/%s.onnx", VOICES_PATH, config.Voice),
+		"--config", fmt.Sprintf("%s/%s.onnx.json", VOICES_PATH, config.Voice),
 		"--json-input",
 		"--output-raw",
 	}
-	if speaker > 0 {
-		cmdArgs = append(cmdArgs, "--speaker-id", strconv.Itoa(speaker))
-	}
-	if lengthScale > 0 && lengthScale != 1.0 {
-		cmdArgs = append(cmdArgs, "--length-scale", strconv.FormatFloat(lengthScale, 'f', -1, 64))
+	if config.LengthScale > 0 && config.LengthScale != 1.0 {
+		cmdArgs = append(cmdArgs, "--length-scale", formatPiperFloat(config.LengthScale))
 	}
+	// The inference parameters are always resolved, 0 being a valid value
+	cmdArgs = append(cmdArgs,
+		"--noise-scale", formatPiperFloat(config.NoiseScale),
+		"--noise-w", formatPiperFloat(config.NoiseW),
+		"--sentence-silence", formatPiperFloat(config.SentenceSilence),
+	)
 	return exec.Command(PIPER_BINARY, cmdArgs...)
 }
 
-func writeInputToPiper(stdin io.WriteCloser, text string) error {
+func writeInputToPiper(stdin io.WriteCloser, text string, speaker int) error {
 	ttsObj := map[string]interface{}{
 		"text": text,
 	}
+	if speaker > 0 {
+		ttsObj["speaker_id"] = speaker
+	}
 
 	jsonStr, err := json.Marshal(ttsObj)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.WriteString(stdin, string(jsonStr))
+	_, err = io.WriteString(stdin, string(jsonStr)+"\n")
 	if err != nil {
 		return fmt.Errorf("failed writing to piper stdin: %v", err)
 	}
@@ -123,129 +133,134 @@ func writeInputToPiper(stdin io.WriteCloser, text string) error {
 	return nil
 }
 
-func buildFfmpegCmd(sampleRate int) *exec.Cmd {
-	return exec.Command("ffmpeg",
+// ffmpegFormat holds the ffmpeg output arguments of an output format.
+type ffmpegFormat struct {
+	Muxer   string
+	Codec   string
+	Bitrate string
+	// Output sample rate, the input one when 0
+	SampleRate int
+}
+
+// Output formats encoded by ffmpeg. Opus only supports a few sample rates,
+// 48 kHz being the one it always resamples to internally.
+var ffmpegFormats = map[string]ffmpegFormat{
+	"mp3":  {Muxer: "mp3", Codec: "libmp3lame"},
+	"opus": {Muxer: "ogg", Codec: "libopus", Bitrate: OPUS_BITRATE, SampleRate: 48000},
+}
+
+func buildFfmpegCmd(outputFormat string, sampleRate int) *exec.Cmd {
+	format := ffmpegFormats[outputFormat]
+	args := []string{
 		"-f", "s16le",
 		"-ar", strconv.Itoa(sampleRate),
 		"-ac", "1",
 		"-i", "pipe:0",
-		"-f", "mp3",
-		"-codec:a", "libmp3lame",
-		"pipe:1",
-	)
+		"-f", format.Muxer,
+		"-codec:a", format.Codec,
+	}
+	if format.Bitrate != "" {
+		args = append(args, "-b:a", format.Bitrate)
+	}
+	if format.SampleRate != 0 {
+		args = append(args, "-ar", strconv.Itoa(format.SampleRate))
+	}
+	return exec.Command("ffmpeg", append(args, "pipe:1")...)
 }
 
-func streamTTSAsMp3(c *gin.Context, voice string, speaker int, text string, sampleRate int, lengthScale float64) error {
-	if _, ok := DOWNLOADED_VOICES[voice]; !ok {
-		return fmt.Errorf("voice not found: %s", voice)
-	}
-	if logInput {
-		fmt.Println(strconv.Quote(text))
+// encodeWithFfmpeg encodes raw PCM audio to one of ffmpegFormats into out.
+func encodeWithFfmpeg(pool *PiperPool, audio io.Reader, out io.Writer, outputFormat string, sampleRate int) error {
+	ffmpegCmd := buildFfmpegCmd(outputFormat, sampleRate)
+	ffmpegCmd.Stdin = audio
+	ffmpegCmd.Stdout = out
+	ffmpegCmd.Stderr = os.Stderr
+	if err := ffmpegCmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %v", err)
 	}
-	piperCmd := buildPiperCmd(voice, speaker, lengthScale)
-	ffmpegCmd := buildFfmpegCmd(sampleRate)
+	pool.track(ffmpegCmd.Process)
+	defer pool.untrack(ffmpegCmd.Process)
+	return ffmpegCmd.Wait()
+}
 
-	piperStdout, err := piperCmd.StdoutPipe()
+func streamTTSWithFfmpeg(c *gin.Context, pool *PiperPool, audio io.Reader, outputFormat string, sampleRate int) error {
+	ffmpegCmd := buildFfmpegCmd(outputFormat, sampleRate)
+	ffmpegStdin, err := ffmpegCmd.StdinPipe()
 	if err != nil {
 		return err
 	}
-	ffmpegCmd.Stdin = piperStdout
-
 	ffmpegStdout, err := ffmpegCmd.StdoutPipe()
 	if err != nil {
 		return err
 	}
-
-	piperCmd.Stderr = os.Stderr
 	ffmpegCmd.Stderr = os.Stderr
 
-	piperStdin, err := piperCmd.StdinPipe()
-	if err != nil {
-		return err
-	}
-
 	if err := ffmpegCmd.Start(); err != nil {
 		return fmt.Errorf("failed to start ffmpeg: %v", err)
 	}
-	trackProcess(ffmpegCmd.Process)
-	if err := piperCmd.Start(); err != nil {
-		ffmpegCmd.Process.Kill()
-		ffmpegCmd.Wait()
-		untrackProcess(ffmpegCmd.Process)
-		return fmt.Errorf("failed to start piper: %v", err)
-	}
-	trackProcess(piperCmd.Process)
-
-	cleanup := func() {
-		piperCmd.Process.Kill()
-		piperCmd.Wait()
-		untrackProcess(piperCmd.Process)
-		ffmpegCmd.Process.Kill()
-		ffmpegCmd.Wait()
-		untrackProcess(ffmpegCmd.Process)
-	}
+	pool.track(ffmpegCmd.Process)
 
-	if err := writeInputToPiper(piperStdin, text); err != nil {
-		piperStdin.Close()
-		cleanup()
-		return err
-	}
-	piperStdin.Close()
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ffmpegStdin, audio)
+		ffmpegStdin.Close()
+		copied <- err
+	}()
 
-	c.Header("Content-Type", "audio/mpeg")
+	c.Header("Content-Type", outputContentTypes[outputFormat])
 	c.Header("Transfer-Encoding", "chunked")
 	c.Header("Connection", "keep-alive")
 	c.Writer.WriteHeader(http.StatusOK)
 
 	streamWavData(c, ffmpegStdout)
 
-	cleanup()
+	ffmpegCmd.Process.Kill()
+	ffmpegCmd.Wait()
+	pool.untrack(ffmpegCmd.Process)
+	if err := <-copied; err != nil {
+		log.Printf("error feeding ffmpeg: %v", err)
+		c.Error(err)
+	}
 	return nil
 }
 
-func streamTTS(c *gin.Context, voice string, speaker int, text string, sampleRate int, channels int, bitsPerSample int, lengthScale float64) error {
-	if _, ok := DOWNLOADED_VOICES[voice]; !ok {
-		return fmt.Errorf("voice not found: %s", voice)
-	}
-	if logInput {
-		fmt.Println(strconv.Quote(text))
-	}
-	cmd := buildPiperCmd(voice, speaker, lengthScale)
-	log.Println("running piper command:", cmd)
-
-	cmd.Stderr = os.Stderr
-
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return err
-	}
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
+// streamTTSWithFLAC encodes raw PCM audio to FLAC in Go as it streams, see
+// flacEncoder.
+func streamTTSWithFLAC(c *gin.Context, audio io.Reader, sampleRate int) {
+	reader, writer := io.Pipe()
+	go func() {
+		encoder, err := newFLACEncoder(writer, sampleRate)
+		if err == nil {
+			_, err = io.Copy(encoder, audio)
+		}
+		if err == nil {
+			err = encoder.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	// Unblocks the encoder when the client goes away
+	defer reader.Close()
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start piper: %v", err)
-	}
-	trackProcess(cmd.Process)
+	c.Header("Content-Type", outputContentTypes["flac"])
+	c.Header("Transfer-Encoding", "chunked")
+	c.Header("Connection", "keep-alive")
+	c.Writer.WriteHeader(http.StatusOK)
 
-	cleanup := func() {
-		cmd.Process.Kill()
-		cmd.Wait()
-		untrackProcess(cmd.Process)
-	}
+	streamWavData(c, reader)
+}
 
-	if err := writeInputToPiper(stdin, text); err != nil {
-		stdin.Close()
-		log.Printf("error writing to piper: %v", err)
-		cleanup()
-		return err
+// streamTTSWithG711 streams raw PCM audio as one of g711Formats.
+func streamTTSWithG711(c *gin.Context, audio io.Reader, sampleRate int, outputFormat string) {
+	format := g711Formats[outputFormat]
+	c.Header("Content-Type", outputContentTypes[outputFormat])
+	c.Header("Transfer-Encoding", "chunked")
+	c.Header("Connection", "keep-alive")
+	c.Writer.WriteHeader(http.StatusOK)
+	if format.WAVFormat != 0 {
+		if _, err := c.Writer.Write(generateWAVFormatHeader(format.WAVFormat, g711SampleRate, 1, 8)); err != nil {
+			c.Error(err)
+			return
+		}
 	}
-	stdin.Close()
 
-	streamWavData(c, stdout)
-
-	cleanup()
-	return nil
+	streamWavData(c, newG711Encoder(audio, sampleRate, format))
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"strings"
 	"testing"
 )
@@ -25,22 +28,39 @@ func TestSpeedToLengthScale(t *testing.T) {
 
 func hasFlagWithValue(args []string, flag, value string) bool {
 	for i, a := range args {
-		if a == flag {
-			return i+1 < len(args) && args[i+1] == value
+		if a == flag && i+1 < len(args) && args[i+1] == value {
+			return true
 		}
 	}
 	return false
 }
 
 func TestBuildPiperCmd_LengthScale(t *testing.T) {
-	cmd := buildPiperCmd("en_US-amy-low", 0, 0.5)
+	cmd := buildPiperCmd(piperConfig{Voice: "en_US-amy-low", LengthScale: 0.5})
 	if !hasFlagWithValue(cmd.Args, "--length-scale", "0.5") {
 		t.Fatalf("expected --length-scale 0.5 in args, got %v", cmd.Args)
 	}
 }
 
+func TestBuildFfmpegCmd_Mp3(t *testing.T) {
+	cmd := buildFfmpegCmd("mp3", 22050)
+	if !hasFlagWithValue(cmd.Args, "-ar", "22050") || !hasFlagWithValue(cmd.Args, "-codec:a", "libmp3lame") || !hasFlagWithValue(cmd.Args, "-f", "mp3") {
+		t.Fatalf("unexpected args %v", cmd.Args)
+	}
+}
+
+func TestBuildFfmpegCmd_Opus(t *testing.T) {
+	cmd := buildFfmpegCmd("opus", 22050)
+	if !hasFlagWithValue(cmd.Args, "-codec:a", "libopus") || !hasFlagWithValue(cmd.Args, "-f", "ogg") {
+		t.Fatalf("expected an Ogg/Opus output, got %v", cmd.Args)
+	}
+	if !hasFlagWithValue(cmd.Args, "-b:a", OPUS_BITRATE) || !hasFlagWithValue(cmd.Args, "-ar", "48000") {
+		t.Fatalf("expected bitrate and 48 kHz output, got %v", cmd.Args)
+	}
+}
+
 func TestBuildPiperCmd_NormalSpeedOmitsLengthScale(t *testing.T) {
-	cmd := buildPiperCmd("en_US-amy-low", 0, 1.0)
+	cmd := buildPiperCmd(piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0})
 	for _, a := range cmd.Args {
 		if a == "--length-scale" {
 			t.Fatalf("expected no --length-scale at speed 1.0, got %v", cmd.Args)
@@ -49,7 +69,7 @@ func TestBuildPiperCmd_NormalSpeedOmitsLengthScale(t *testing.T) {
 }
 
 func TestBuildPiperCmd_NonPositiveLengthScaleOmitsFlag(t *testing.T) {
-	cmd := buildPiperCmd("en_US-amy-low", 0, 0)
+	cmd := buildPiperCmd(piperConfig{Voice: "en_US-amy-low"})
 	for _, a := range cmd.Args {
 		if a == "--length-scale" {
 			t.Fatalf("expected no --length-scale for non-positive value, got %v", cmd.Args)
@@ -57,12 +77,105 @@ func TestBuildPiperCmd_NonPositiveLengthScaleOmitsFlag(t *testing.T) {
 	}
 }
 
-func TestBuildPiperCmd_SpeakerId(t *testing.T) {
-	cmd := buildPiperCmd("en_US-amy-low", 3, 1.0)
-	if !hasFlagWithValue(cmd.Args, "--speaker-id", "3") {
-		t.Fatalf("expected --speaker-id 3 in args, got %v", cmd.Args)
-	}
+func TestBuildPiperCmd_ModelPath(t *testing.T) {
+	cmd := buildPiperCmd(piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0})
 	if !strings.Contains(strings.Join(cmd.Args, " "), "en_US-amy-low.onnx") {
 		t.Fatalf("expected model path in args, got %v", cmd.Args)
 	}
 }
+
+func TestBuildPiperCmd_InferenceParameters(t *testing.T) {
+	cmd := buildPiperCmd(piperConfig{Voice: "en_US-amy-low", NoiseScale: 0.5, NoiseW: 0.6, SentenceSilence: 0.3})
+	if !hasFlagWithValue(cmd.Args, "--noise-scale", "0.5") {
+		t.Fatalf("expected --noise-scale 0.5 in args, got %v", cmd.Args)
+	}
+	if !hasFlagWithValue(cmd.Args, "--noise-w", "0.6") {
+		t.Fatalf("expected --noise-w 0.6 in args, got %v", cmd.Args)
+	}
+	if !hasFlagWithValue(cmd.Args, "--sentence-silence", "0.3") {
+		t.Fatalf("expected --sentence-silence 0.3 in args, got %v", cmd.Args)
+	}
+}
+
+func TestBuildPiperCmd_ZeroInferenceParameters(t *testing.T) {
+	cmd := buildPiperCmd(piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0})
+	if !hasFlagWithValue(cmd.Args, "--noise-scale", "0") || !hasFlagWithValue(cmd.Args, "--noise-w", "0") {
+		t.Fatalf("expected zero inference parameters in args, got %v", cmd.Args)
+	}
+}
+
+func TestApplyInferenceDefaults(t *testing.T) {
+	details := VoiceDetails{Inference: VoiceDetailsInference{NoiseScale: 0.333, NoiseW: 0.4, SentenceSilence: 0.2}}
+	noiseScale, noiseW := 0.9, 0.0
+	config := applyInferenceDefaults(piperConfig{}, inferenceParameters{NoiseScale: &noiseScale, NoiseW: &noiseW}, details)
+	if config.NoiseScale != 0.9 {
+		t.Fatalf("expected explicit noise scale to be kept, got %v", config.NoiseScale)
+	}
+	if config.NoiseW != 0 {
+		t.Fatalf("expected explicit zero noise w to be kept, got %v", config.NoiseW)
+	}
+	if config.SentenceSilence != 0.2 {
+		t.Fatalf("expected voice default sentence silence, got %+v", config)
+	}
+}
+
+func TestWriteInputToPiper_NewlineTerminated(t *testing.T) {
+	var sb strings.Builder
+	if err := writeInputToPiper(nopWriteCloser{&sb}, "hello", 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sb.String() != "{\"text\":\"hello\"}\n" {
+		t.Fatalf("unexpected piper input %q", sb.String())
+	}
+}
+
+func TestWriteInputToPiper_SpeakerId(t *testing.T) {
+	var sb strings.Builder
+	if err := writeInputToPiper(nopWriteCloser{&sb}, "hello", 3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sb.String() != "{\"speaker_id\":3,\"text\":\"hello\"}\n" {
+		t.Fatalf("unexpected piper input %q", sb.String())
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestStreamTTSWithFLAC(t *testing.T) {
+	samples := testFLACSamples(flacBlockSize + 10)
+	c, w := newTestContext("GET", "/api/tts/stream", "")
+	streamTTSWithFLAC(c, bytes.NewReader(pcmBytes(samples)), 16000)
+	if w.Header().Get("Content-Type") != "audio/flac" {
+		t.Fatalf("unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+	decoded, sampleRate, _, _, err := decodeTestFLAC(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if sampleRate != 16000 || !bytes.Equal(pcmBytes(decoded), pcmBytes(samples)) {
+		t.Fatalf("expected streamed samples to round trip, got %d samples at %d Hz", len(decoded), sampleRate)
+	}
+}
+
+func TestStreamTTSWithG711(t *testing.T) {
+	input := pcmBytes(sineSamples(16000, 16000, 440, 10000))
+	for format, wavFormat := range map[string]int{"ulaw": 0, "alaw-wav": wavFormatALaw} {
+		c, w := newTestContext("GET", "/api/tts/stream", "")
+		streamTTSWithG711(c, bytes.NewReader(input), 16000, format)
+		if w.Header().Get("Content-Type") != outputContentTypes[format] {
+			t.Fatalf("%s: unexpected content type %q", format, w.Header().Get("Content-Type"))
+		}
+		body := w.Body.Bytes()
+		if wavFormat != 0 {
+			if binary.LittleEndian.Uint16(body[20:22]) != uint16(wavFormat) || binary.LittleEndian.Uint32(body[24:28]) != g711SampleRate {
+				t.Fatalf("%s: unexpected WAV header %x", format, body[:wavExtendedHeaderSize])
+			}
+			body = body[wavExtendedHeaderSize:]
+		}
+		if len(body) != g711SampleRate {
+			t.Fatalf("%s: expected %d bytes of audio, got %d", format, g711SampleRate, len(body))
+		}
+	}
+}
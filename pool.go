@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// piper logs this line on stderr once all audio for an input line has been
+// written to stdout, which is how workers detect the end of an utterance.
+const piperUtteranceDoneMarker = "Real-time factor"
+
+// How long to wait for more output once piper reported an utterance as done.
+// The audio is already in the pipe by then, so this only bounds the final read.
+const piperDrainTimeout = 100 * time.Millisecond
+
+// How long an utterance may take before its worker is considered stuck, in
+// case piper never logs piperUtteranceDoneMarker.
+var piperUtteranceTimeout = time.Duration(PIPER_UTTERANCE_TIMEOUT_SECONDS) * time.Second
+
+var (
+	errPoolClosed            = errors.New("piper pool is closed")
+	errPiperUtteranceTimeout = errors.New("piper did not finish the utterance in time")
+)
+
+// piperConfig identifies the command line a piper worker was started with.
+// Workers are only shared between requests with an identical config, except
+// for Speaker which is sent with each input line.
+type piperConfig struct {
+	Voice           string
+	Speaker         int
+	LengthScale     float64
+	NoiseScale      float64
+	NoiseW          float64
+	SentenceSilence float64
+}
+
+type piperWorker struct {
+	config   piperConfig
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *os.File
+	exited   chan struct{}
+	started  time.Time
+	lastUsed time.Time
+
+	mu       sync.Mutex
+	finished bool
+	inSync   bool
+}
+
+func startPiperWorker(config piperConfig) (*piperWorker, error) {
+	cmd := buildPiperCmd(config)
+	log.Println("starting piper worker:", cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdoutR.Close()
+		stderrR.Close()
+		return nil, fmt.Errorf("failed to start piper: %v", err)
+	}
+
+	w := &piperWorker{
+		config:   config,
+		cmd:      cmd,
+		stdin:    stdin,
+		stdout:   stdoutR,
+		exited:   make(chan struct{}),
+		started:  time.Now(),
+		lastUsed: time.Now(),
+		inSync:   true,
+	}
+	go w.watchStderr(stderrR)
+	go func() {
+		cmd.Wait()
+		stdoutR.Close()
+		close(w.exited)
+	}()
+	return w, nil
+}
+
+func (w *piperWorker) watchStderr(stderr io.ReadCloser) {
+	defer stderr.Close()
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(os.Stderr, line)
+		if strings.Contains(line, piperUtteranceDoneMarker) {
+			w.mu.Lock()
+			w.finished = true
+			w.stdout.SetReadDeadline(time.Now().Add(piperDrainTimeout))
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *piperWorker) alive() bool {
+	select {
+	case <-w.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (w *piperWorker) kill() {
+	w.cmd.Process.Kill()
+	<-w.exited
+}
+
+// synthesize sends text to the worker and returns a reader over the raw PCM
+// of that utterance only, spoken by speaker for multi-speaker voices. The
+// reader must be consumed up to io.EOF for the worker to be reusable. It fails
+// with errPiperUtteranceTimeout after piperUtteranceTimeout, leaving the
+// worker to be replaced.
+func (w *piperWorker) synthesize(text string, speaker int) (io.Reader, error) {
+	w.mu.Lock()
+	w.inSync = false
+	w.stdout.SetReadDeadline(time.Now().Add(piperUtteranceTimeout))
+	w.mu.Unlock()
+	if err := writeInputToPiper(w.stdin, text, speaker); err != nil {
+		return nil, err
+	}
+	return &utteranceReader{worker: w}, nil
+}
+
+func (w *piperWorker) reusable() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.inSync && w.alive()
+}
+
+type utteranceReader struct {
+	worker *piperWorker
+	done   bool
+}
+
+func (r *utteranceReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	w := r.worker
+
+	w.mu.Lock()
+	if w.finished {
+		w.stdout.SetReadDeadline(time.Now().Add(piperDrainTimeout))
+	}
+	w.mu.Unlock()
+
+	n, err := w.stdout.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		r.done = true
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if !w.finished {
+			// Still out of sync, so release kills the worker
+			return n, errPiperUtteranceTimeout
+		}
+		w.stdout.SetReadDeadline(time.Time{})
+		w.finished = false
+		w.inSync = true
+		return n, io.EOF
+	}
+	if err != nil {
+		r.done = true
+	}
+	return n, err
+}
+
+// PiperPool keeps long-lived piper processes per piperConfig so requests
+// don't pay the model loading cost, and tracks every child process the
+// server spawns so they can be killed on shutdown. At most maxWorkers
+// workers run per config, and maxProcesses in total.
+type PiperPool struct {
+	mu        sync.Mutex
+	idle      map[piperConfig][]*piperWorker
+	workers   map[piperConfig]int
+	total     int
+	processes map[int]*os.Process
+	// When the files of each voice were last deleted
+	discarded    map[string]time.Time
+	released     chan struct{}
+	closed       bool
+	minWorkers   int
+	maxWorkers   int
+	maxProcesses int
+	idleTimeout  time.Duration
+}
+
+func newPiperPool(minWorkers, maxWorkers, maxProcesses int, idleTimeout time.Duration) *PiperPool {
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+	if maxProcesses < maxWorkers {
+		maxProcesses = maxWorkers
+	}
+	if minWorkers > maxWorkers {
+		minWorkers = maxWorkers
+	}
+	return &PiperPool{
+		idle:         make(map[piperConfig][]*piperWorker),
+		workers:      make(map[piperConfig]int),
+		processes:    make(map[int]*os.Process),
+		discarded:    make(map[string]time.Time),
+		released:     make(chan struct{}),
+		minWorkers:   minWorkers,
+		maxWorkers:   maxWorkers,
+		maxProcesses: maxProcesses,
+		idleTimeout:  idleTimeout,
+	}
+}
+
+func initPiperPool() *PiperPool {
+	p := newPiperPool(PIPER_MIN_WORKERS, PIPER_MAX_WORKERS, PIPER_MAX_PROCESSES, time.Duration(PIPER_WORKER_IDLE_MINUTES)*time.Minute)
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			p.evictIdle()
+		}
+	}()
+	return p
+}
+
+func (p *PiperPool) track(proc *os.Process) {
+	p.mu.Lock()
+	p.processes[proc.Pid] = proc
+	p.mu.Unlock()
+}
+
+func (p *PiperPool) untrack(proc *os.Process) {
+	p.mu.Lock()
+	delete(p.processes, proc.Pid)
+	p.mu.Unlock()
+}
+
+// notifyLocked wakes up every acquire waiting for a worker slot.
+func (p *PiperPool) notifyLocked() {
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+// workerConfig returns the config of the workers able to synthesize with
+// config.
+func workerConfig(config piperConfig) piperConfig {
+	config.Speaker = 0
+	return config
+}
+
+// acquire returns an idle worker for config, starting a new one if fewer
+// than maxWorkers exist for it, or waits for one to be released. Once
+// maxProcesses workers exist, the least recently used idle worker of another
+// config is killed to make room.
+func (p *PiperPool) acquire(ctx context.Context, config piperConfig) (*piperWorker, error) {
+	config = workerConfig(config)
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+		if idle := p.idle[config]; len(idle) > 0 {
+			w := idle[len(idle)-1]
+			p.idle[config] = idle[:len(idle)-1]
+			p.mu.Unlock()
+			if w.alive() {
+				return w, nil
+			}
+			p.discard(w)
+			continue
+		}
+		if p.workers[config] < p.maxWorkers && p.total >= p.maxProcesses {
+			if w := p.takeLeastRecentlyUsedLocked(); w != nil {
+				p.mu.Unlock()
+				log.Printf("evicting idle piper worker for voice %s to start another one", w.config.Voice)
+				p.discard(w)
+				continue
+			}
+		}
+		if p.workers[config] < p.maxWorkers && p.total < p.maxProcesses {
+			p.workers[config]++
+			p.total++
+			p.mu.Unlock()
+			w, err := startPiperWorker(config)
+			if err != nil {
+				p.mu.Lock()
+				p.workers[config]--
+				p.total--
+				p.notifyLocked()
+				p.mu.Unlock()
+				return nil, err
+			}
+			p.track(w.cmd.Process)
+			return w, nil
+		}
+		released := p.released
+		p.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// takeLeastRecentlyUsedLocked removes the idle worker released the longest
+// ago from the idle workers, or returns nil when none is idle. p.mu must be
+// held.
+func (p *PiperPool) takeLeastRecentlyUsedLocked() *piperWorker {
+	var oldest *piperWorker
+	for _, idle := range p.idle {
+		// idle is ordered by release time
+		if len(idle) > 0 && (oldest == nil || idle[0].lastUsed.Before(oldest.lastUsed)) {
+			oldest = idle[0]
+		}
+	}
+	if oldest != nil {
+		p.idle[oldest.config] = p.idle[oldest.config][1:]
+	}
+	return oldest
+}
+
+// release hands a worker back to the pool. Workers that died, whose last
+// utterance was not fully read or whose voice was discarded since they
+// started are killed instead of being reused.
+func (p *PiperPool) release(w *piperWorker) {
+	if !w.reusable() {
+		p.discard(w)
+		return
+	}
+	w.lastUsed = time.Now()
+
+	p.mu.Lock()
+	if p.closed || !w.started.After(p.discarded[w.config.Voice]) {
+		p.mu.Unlock()
+		p.discard(w)
+		return
+	}
+	p.idle[w.config] = append(p.idle[w.config], w)
+	p.notifyLocked()
+	p.mu.Unlock()
+}
+
+func (p *PiperPool) discard(w *piperWorker) {
+	w.kill()
+	p.untrack(w.cmd.Process)
+	p.mu.Lock()
+	p.workers[w.config]--
+	p.total--
+	if p.workers[w.config] <= 0 {
+		delete(p.workers, w.config)
+	}
+	p.notifyLocked()
+	p.mu.Unlock()
+}
+
+// discardVoice kills the workers of a voice whose files were deleted, so
+// they don't keep running a model that is gone. Workers in use are killed
+// when they are released.
+func (p *PiperPool) discardVoice(voice string) {
+	var discarded []*piperWorker
+
+	p.mu.Lock()
+	p.discarded[voice] = time.Now()
+	for config, idle := range p.idle {
+		if config.Voice == voice {
+			discarded = append(discarded, idle...)
+			delete(p.idle, config)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, w := range discarded {
+		log.Printf("discarding piper worker for deleted voice %s", voice)
+		p.discard(w)
+	}
+}
+
+// warm starts idle workers for config until minWorkers exist, or until
+// maxProcesses workers exist in total.
+func (p *PiperPool) warm(config piperConfig) error {
+	config = workerConfig(config)
+	for {
+		p.mu.Lock()
+		if p.closed || p.workers[config] >= p.minWorkers || p.total >= p.maxProcesses {
+			p.mu.Unlock()
+			return nil
+		}
+		p.workers[config]++
+		p.total++
+		p.mu.Unlock()
+
+		w, err := startPiperWorker(config)
+		if err != nil {
+			p.mu.Lock()
+			p.workers[config]--
+			p.total--
+			p.mu.Unlock()
+			return err
+		}
+		p.track(w.cmd.Process)
+		p.release(w)
+	}
+}
+
+// evictIdle kills workers that have been idle longer than idleTimeout,
+// keeping at least minWorkers per config.
+func (p *PiperPool) evictIdle() {
+	cutoff := time.Now().Add(-p.idleTimeout)
+	var evicted []*piperWorker
+
+	p.mu.Lock()
+	for config, idle := range p.idle {
+		remaining := p.workers[config]
+		kept := idle[:0]
+		// idle is ordered by release time, so the oldest workers go first.
+		for _, w := range idle {
+			if w.lastUsed.Before(cutoff) && remaining > p.minWorkers {
+				evicted = append(evicted, w)
+				remaining--
+				continue
+			}
+			kept = append(kept, w)
+		}
+		p.idle[config] = kept
+	}
+	p.mu.Unlock()
+
+	for _, w := range evicted {
+		log.Printf("evicting idle piper worker for voice %s", w.config.Voice)
+		p.discard(w)
+	}
+}
+
+// close kills all workers and any other tracked process.
+func (p *PiperPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.idle = make(map[piperConfig][]*piperWorker)
+	for _, proc := range p.processes {
+		proc.Kill()
+	}
+	p.notifyLocked()
+	p.mu.Unlock()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakePiperScript echoes every input line back as "audio" and then logs the
+// same end of utterance line piper does.
+const fakePiperScript = `#!/bin/sh
+while read -r line; do
+	printf 'audio:%s' "$line"
+	echo "[piper] [info] Real-time factor: 0.01 (infer=0.01 sec, audio=1 sec)" >&2
+done
+`
+
+func useFakePiper(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "piper")
+	if err := os.WriteFile(path, []byte(fakePiperScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := PIPER_BINARY
+	PIPER_BINARY = path
+	t.Cleanup(func() { PIPER_BINARY = previous })
+}
+
+// silentPiperScript echoes input like fakePiperScript without ever logging
+// the end of utterance line.
+const silentPiperScript = `#!/bin/sh
+while read -r line; do
+	printf 'audio:%s' "$line"
+done
+`
+
+func synthesizeAll(t *testing.T, w *piperWorker, text string) string {
+	t.Helper()
+	audio, err := w.synthesize(text, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := io.ReadAll(audio)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	return string(data)
+}
+
+func TestPiperPool_ReusesWorker(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+	config := piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0}
+
+	w, err := pool.acquire(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := synthesizeAll(t, w, "hello"); got != `audio:{"text":"hello"}` {
+		t.Fatalf("unexpected first utterance %q", got)
+	}
+	pid := w.cmd.Process.Pid
+	pool.release(w)
+
+	w, err = pool.acquire(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pool.release(w)
+	if w.cmd.Process.Pid != pid {
+		t.Fatalf("expected worker %d to be reused, got %d", pid, w.cmd.Process.Pid)
+	}
+	if got := synthesizeAll(t, w, "world"); got != `audio:{"text":"world"}` {
+		t.Fatalf("unexpected second utterance %q", got)
+	}
+}
+
+func TestPiperPool_DiscardsUnfinishedWorker(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+	config := piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0}
+
+	w, err := pool.acquire(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := w.synthesize("hello", 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pool.release(w)
+	if w.alive() {
+		t.Fatal("expected worker with unread output to be killed")
+	}
+	if n := len(pool.idle[config]); n != 0 {
+		t.Fatalf("expected no idle workers, got %d", n)
+	}
+}
+
+func TestPiperPool_AcquireWaitsForMaxWorkers(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+	config := piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0}
+
+	w, err := pool.acquire(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pool.release(w)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.acquire(ctx, config); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestPiperPool_EvictIdleKeepsMinWorkers(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(1, 2, 2, 0)
+	defer pool.close()
+	config := piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0}
+
+	w1, _ := pool.acquire(context.Background(), config)
+	w2, _ := pool.acquire(context.Background(), config)
+	pool.release(w1)
+	pool.release(w2)
+	pool.evictIdle()
+
+	if n := len(pool.idle[config]); n != 1 {
+		t.Fatalf("expected 1 idle worker after eviction, got %d", n)
+	}
+	if w1.alive() {
+		t.Fatal("expected oldest worker to be evicted")
+	}
+	if !w2.alive() {
+		t.Fatal("expected newest worker to be kept")
+	}
+}
+
+func TestPiperPool_DiscardVoiceKillsItsWorkers(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 2, 3, time.Minute)
+	defer pool.close()
+	config := piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0}
+	other := piperConfig{Voice: "en_US-ryan-low", LengthScale: 1.0}
+
+	idle, _ := pool.acquire(context.Background(), config)
+	busy, _ := pool.acquire(context.Background(), config)
+	kept, _ := pool.acquire(context.Background(), other)
+	pool.release(idle)
+	pool.release(kept)
+	pool.discardVoice(config.Voice)
+
+	if idle.alive() {
+		t.Fatal("expected idle worker of the discarded voice to be killed")
+	}
+	pool.release(busy)
+	if busy.alive() {
+		t.Fatal("expected worker of the discarded voice to be killed on release")
+	}
+	if !kept.alive() {
+		t.Fatal("expected worker of another voice to be kept")
+	}
+
+	w, err := pool.acquire(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pool.release(w)
+	if n := len(pool.idle[config]); n != 1 {
+		t.Fatalf("expected workers started afterwards to be reused, got %d idle", n)
+	}
+}
+
+func TestPiperPool_CloseKillsWorkers(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	config := piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0}
+
+	w, err := pool.acquire(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pool.close()
+	select {
+	case <-w.exited:
+	case <-time.After(time.Second):
+		t.Fatal("expected worker to be killed on close")
+	}
+	if _, err := pool.acquire(context.Background(), config); err != errPoolClosed {
+		t.Fatalf("expected errPoolClosed, got %v", err)
+	}
+}
+
+// liveProcesses returns how many piper processes the pool has running.
+func liveProcesses(pool *PiperPool) int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return len(pool.processes)
+}
+
+func TestPiperPool_CapsProcessesAcrossConfigs(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 2, time.Minute)
+	defer pool.close()
+
+	var workers []*piperWorker
+	for i := 0; i < 20; i++ {
+		config := piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0 + float64(i)/100}
+		w, err := pool.acquire(context.Background(), config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		synthesizeAll(t, w, "hello")
+		pool.release(w)
+		workers = append(workers, w)
+		if n := liveProcesses(pool); n > 2 {
+			t.Fatalf("expected at most 2 piper processes, got %d after %d configs", n, i+1)
+		}
+	}
+	for _, w := range workers[:len(workers)-2] {
+		if w.alive() {
+			t.Fatal("expected least recently used workers to be killed")
+		}
+	}
+}
+
+func TestPiperPool_AcquireWaitsForMaxProcesses(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+
+	w, err := pool.acquire(context.Background(), piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other := piperConfig{Voice: "en_US-amy-low", LengthScale: 1.5}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.acquire(ctx, other); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded while the only process is busy, got %v", err)
+	}
+
+	pool.release(w)
+	w, err = pool.acquire(context.Background(), other)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pool.release(w)
+	if n := liveProcesses(pool); n != 1 {
+		t.Fatalf("expected 1 piper process, got %d", n)
+	}
+}
+
+func TestPiperPool_SharesWorkersBetweenSpeakers(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+
+	w, err := pool.acquire(context.Background(), piperConfig{Voice: "en_US-libritts-high", Speaker: 3, LengthScale: 1.0})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	audio, err := w.synthesize("hello", 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := io.ReadAll(audio); string(data) != `audio:{"speaker_id":3,"text":"hello"}` {
+		t.Fatalf("unexpected utterance %q", data)
+	}
+	pid := w.cmd.Process.Pid
+	pool.release(w)
+
+	w, err = pool.acquire(context.Background(), piperConfig{Voice: "en_US-libritts-high", Speaker: 5, LengthScale: 1.0})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pool.release(w)
+	if w.cmd.Process.Pid != pid {
+		t.Fatal("expected the worker to be reused for another speaker")
+	}
+}
+
+func TestPiperPool_ReplacesWorkerAfterUtteranceTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "piper")
+	if err := os.WriteFile(path, []byte(silentPiperScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous, previousTimeout := PIPER_BINARY, piperUtteranceTimeout
+	PIPER_BINARY, piperUtteranceTimeout = path, 200*time.Millisecond
+	defer func() { PIPER_BINARY, piperUtteranceTimeout = previous, previousTimeout }()
+
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+	config := piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0}
+	w, err := pool.acquire(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	audio, err := w.synthesize("hello", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(audio)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != errPiperUtteranceTimeout {
+			t.Fatalf("expected errPiperUtteranceTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the read to time out")
+	}
+
+	pid := w.cmd.Process.Pid
+	pool.release(w)
+	if w.alive() {
+		t.Fatal("expected the stuck worker to be killed")
+	}
+	w, err = pool.acquire(context.Background(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pool.release(w)
+	if w.cmd.Process.Pid == pid {
+		t.Fatal("expected a new worker")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TTSPreset holds request values applied when a request names the preset.
+// Values the request sets itself take precedence.
+type TTSPreset struct {
+	Voice           string   `json:"voice,omitempty"`
+	Speaker         string   `json:"speaker,omitempty"`
+	Speed           float64  `json:"speed,omitempty"`
+	OutputFormat    string   `json:"outputFormat,omitempty"`
+	SSML            bool     `json:"ssml,omitempty"`
+	NoiseScale      *float64 `json:"noiseScale,omitempty"`
+	NoiseW          *float64 `json:"noiseW,omitempty"`
+	SentenceSilence *float64 `json:"sentenceSilence,omitempty"`
+	SampleRate      int      `json:"sampleRate,omitempty"`
+	Channels        int      `json:"channels,omitempty"`
+	BitsPerSample   int      `json:"bitsPerSample,omitempty"`
+}
+
+var ttsPresets = loadTTSPresets(PRESETS_PATH)
+
+// loadTTSPresets reads a JSON object of presets keyed by name. No presets
+// are defined when path is empty.
+func loadTTSPresets(path string) map[string]TTSPreset {
+	presets := make(map[string]TTSPreset)
+	if path == "" {
+		return presets
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read presets from %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &presets); err != nil {
+		log.Fatalf("Invalid presets in %s: %v", path, err)
+	}
+	return presets
+}
+
+// presetDefault returns the preset value of a request parameter when the
+// preset sets it, defaultValue otherwise.
+func presetDefault[T comparable](presetValue T, defaultValue T) T {
+	var zero T
+	if presetValue != zero {
+		return presetValue
+	}
+	return defaultValue
+}
+
+func presetsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, ttsPresets)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func useTTSPresets(t *testing.T, presets map[string]TTSPreset) {
+	t.Helper()
+	previous := ttsPresets
+	ttsPresets = presets
+	t.Cleanup(func() { ttsPresets = previous })
+}
+
+func TestLoadTTSPresets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presets.json")
+	os.WriteFile(path, []byte(`{"announcer":{"voice":"en_GB-alan-medium","speed":1.1,"noiseScale":0.5,"outputFormat":"mp3"}}`), 0644)
+	presets := loadTTSPresets(path)
+	announcer, ok := presets["announcer"]
+	if !ok || announcer.Voice != "en_GB-alan-medium" || announcer.Speed != 1.1 || announcer.NoiseScale == nil || *announcer.NoiseScale != 0.5 || announcer.OutputFormat != "mp3" {
+		t.Fatalf("unexpected presets %+v", presets)
+	}
+	if len(loadTTSPresets("")) != 0 {
+		t.Fatal("expected no presets without a path")
+	}
+}
+
+func TestGetTTSRequestInput_MergesPreset(t *testing.T) {
+	useTTSPresets(t, map[string]TTSPreset{
+		"announcer": {Voice: "en_GB-alan-medium", Speed: 1.1, NoiseScale: floatPtr(0.5), OutputFormat: "mp3"},
+	})
+
+	c, _ := newTestContext("POST", "/?speed=1.3", `{"text":"hello","preset":"announcer","noiseScale":0.9}`)
+	input, err := getTTSRequestInput(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if input.Voice != "en_GB-alan-medium" || input.OutputFormat != "mp3" {
+		t.Fatalf("expected preset values, got %+v", input)
+	}
+	if input.Speed != 1.3 || *input.NoiseScale != 0.9 {
+		t.Fatalf("expected request values to take precedence, got %+v", input)
+	}
+}
+
+func TestGetTTSRequestInput_PresetFromQuery(t *testing.T) {
+	useTTSPresets(t, map[string]TTSPreset{"fast": {Speed: 1.5}})
+	c, _ := newTestContext("GET", "/?text=hello&preset=fast", "")
+	input, _ := getTTSRequestInput(c)
+	if input.Speed != 1.5 || input.Voice != DEFAULT_VOICE {
+		t.Fatalf("unexpected input %+v", input)
+	}
+}
+
+func TestPlanTTS_UnknownPreset(t *testing.T) {
+	useTTSPresets(t, map[string]TTSPreset{})
+	voices := Voices{}
+	_, err := planTTS(TTSRequestInput{Text: "hello", Voice: "x", OutputFormat: "wav", Preset: "missing"}, &voices)
+	if err == nil || !strings.Contains(err.Error(), "unknown preset") {
+		t.Fatalf("expected unknown preset error, got %v", err)
+	}
+}
+
+func TestPresetsHandler(t *testing.T) {
+	useTTSPresets(t, map[string]TTSPreset{"announcer": {Voice: "en_GB-alan-medium"}})
+	c, w := newTestContext("GET", "/api/presets", "")
+	presetsHandler(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var presets map[string]TTSPreset
+	if err := json.Unmarshal(w.Body.Bytes(), &presets); err != nil || presets["announcer"].Voice != "en_GB-alan-medium" {
+		t.Fatalf("unexpected body %s", w.Body.String())
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	errVoicesQuotaExceeded = errors.New("not enough space left in VOICES_PATH")
+	errVoiceNotInstalled   = errors.New("voice is not installed and on-demand downloads are disabled")
+)
+
+// Appended to the files of an evicted voice until they are deleted
+const evictedFileSuffix = ".evicted"
+
+// reserve makes room in VOICES_PATH for the files of a voice that are about
+// to be downloaded, evicting the least recently used voices once VOICES_MAX_MB
+// would be exceeded. It fails with errVoicesQuotaExceeded when evicting every
+// voice that can be isn't enough.
+func (r *VoiceRegistry) reserve(voices *Voices, voiceName string) error {
+	if VOICES_MAX_MB <= 0 {
+		return nil
+	}
+	voice, ok := (*voices)[voiceName]
+	if !ok {
+		return nil
+	}
+	var needed int64
+	for fileName, fileInfo := range voice.Files {
+		if filepath.Base(fileName) == "MODEL_CARD" {
+			continue
+		}
+		if _, err := os.Stat(voiceFilePath(fileName)); err != nil {
+			needed += fileInfo.SizeBytes
+		}
+	}
+	return r.reserveBytes(voices, voiceName, needed)
+}
+
+// reserveBytes makes room in VOICES_PATH for needed bytes of files of
+// voiceName, as reserve does. The reservation is held until the files are
+// written and released. The files of evicted voices are deleted once the
+// registry is unlocked, and their piper workers are discarded.
+func (r *VoiceRegistry) reserveBytes(voices *Voices, voiceName string, needed int64) error {
+	if VOICES_MAX_MB <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	evicted, files, err := r.reserveBytesLocked(voices, voiceName, needed)
+	onEvict := r.onEvict
+	r.mu.Unlock()
+
+	for _, path := range files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete %s: %v", path, err)
+		}
+	}
+	if onEvict != nil {
+		for _, name := range evicted {
+			onEvict(name)
+		}
+	}
+	return err
+}
+
+// reserveBytesLocked evicts voices until needed bytes fit in VOICES_MAX_MB
+// and reserves them for voiceName. The files of the evicted voices are only
+// moved aside, and returned for the caller to delete. r.mu must be held.
+func (r *VoiceRegistry) reserveBytesLocked(voices *Voices, voiceName string, needed int64) ([]string, []string, error) {
+	used, err := directorySize(VOICES_PATH)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Partial downloads are counted twice, which errs on the safe side
+	for _, size := range r.reserved {
+		used += size
+	}
+	maxBytes := int64(VOICES_MAX_MB) * 1024 * 1024
+
+	var evicted, files []string
+	for _, candidate := range r.evictionCandidatesLocked(voices, voiceName) {
+		if used+needed <= maxBytes {
+			break
+		}
+		size := voiceFilesSize((*voices)[candidate])
+		moved, err := moveVoiceFilesAside((*voices)[candidate])
+		files = append(files, moved...)
+		if err != nil {
+			log.Printf("Failed to evict voice %s: %v", candidate, err)
+			continue
+		}
+		delete(r.installed, candidate)
+		delete(r.lastUsed, candidate)
+		evicted = append(evicted, candidate)
+		used -= size
+		log.Printf("Evicted voice %s to free %d bytes in %s\n", candidate, size, VOICES_PATH)
+	}
+	if used+needed > maxBytes {
+		return evicted, files, errVoicesQuotaExceeded
+	}
+	r.reserved[voiceName] = needed
+	return evicted, files, nil
+}
+
+// moveVoiceFilesAside renames the files of a voice so that they are no longer
+// found under their names, and returns their new paths. A download of the
+// voice started before they are deleted then can't lose its files with them.
+func moveVoiceFilesAside(voice Voice) ([]string, error) {
+	var moved []string
+	for fileName := range voice.Files {
+		if filepath.Base(fileName) == "MODEL_CARD" {
+			continue
+		}
+		for _, path := range []string{voiceFilePath(fileName), voiceFilePath(fileName) + partialDownloadSuffix} {
+			if err := os.Rename(path, path+evictedFileSuffix); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return moved, err
+			}
+			moved = append(moved, path+evictedFileSuffix)
+		}
+	}
+	return moved, nil
+}
+
+// release drops the reservation of voiceName once its files are written or
+// given up on.
+func (r *VoiceRegistry) release(voiceName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.reserved, voiceName)
+}
+
+// evictionCandidatesLocked returns the installed voices that may be evicted
+// to make room for voiceName, least recently used first. PRELOAD_VOICES are
+// pinned, and so are custom voices since they can't be downloaded again.
+// Voices never used since startup are ordered by when they were installed.
+// r.mu must be held.
+func (r *VoiceRegistry) evictionCandidatesLocked(voices *Voices, voiceName string) []string {
+	pinned := map[string]bool{voiceName: true}
+	for _, name := range PRELOAD_VOICES {
+		pinned[name] = true
+	}
+
+	lastUsed := make(map[string]time.Time)
+	var candidates []string
+	for name := range r.installed {
+		voice, ok := (*voices)[name]
+		if pinned[name] || !ok || voice.Custom {
+			continue
+		}
+		candidates = append(candidates, name)
+		if used, ok := r.lastUsed[name]; ok {
+			lastUsed[name] = used
+		} else if info, err := os.Stat(voiceFilePath(name + ".onnx")); err == nil {
+			lastUsed[name] = info.ModTime()
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return lastUsed[candidates[i]].Before(lastUsed[candidates[j]])
+	})
+	return candidates
+}
+
+// voiceFilesSize returns the size of the files of a voice in VOICES_PATH.
+func voiceFilesSize(voice Voice) int64 {
+	var size int64
+	for fileName := range voice.Files {
+		if info, err := os.Stat(voiceFilePath(fileName)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func directorySize(dir string) (int64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if info, err := file.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
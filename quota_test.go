@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testQuotaFileSize = 400 * 1024
+
+func useVoicesQuota(t *testing.T, maxMB int, pinned ...string) {
+	t.Helper()
+	previousMax, previousPinned := VOICES_MAX_MB, PRELOAD_VOICES
+	VOICES_MAX_MB, PRELOAD_VOICES = maxMB, pinned
+	t.Cleanup(func() { VOICES_MAX_MB, PRELOAD_VOICES = previousMax, previousPinned })
+}
+
+// installQuotaVoice writes a voice model of testQuotaFileSize bytes.
+func installQuotaVoice(t *testing.T, r *VoiceRegistry, dir string, name string, lastUsed time.Time) Voice {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name+".onnx"), make([]byte, testQuotaFileSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.set(name, VoiceDetails{})
+	r.lastUsed[name] = lastUsed
+	return Voice{Key: name, Files: map[string]File{"en/" + name + ".onnx": {SizeBytes: testQuotaFileSize}}}
+}
+
+func TestVoiceRegistry_ReserveEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	useVoicesQuota(t, 1)
+	r := newVoiceRegistry()
+	var evicted []string
+	r.onEvict = func(voiceName string) { evicted = append(evicted, voiceName) }
+	now := time.Now()
+	voices := Voices{
+		"old-voice":    installQuotaVoice(t, r, dir, "old-voice", now.Add(-time.Hour)),
+		"recent-voice": installQuotaVoice(t, r, dir, "recent-voice", now),
+		"new-voice":    {Key: "new-voice", Files: map[string]File{"en/new-voice.onnx": {SizeBytes: testQuotaFileSize}}},
+	}
+
+	if err := r.reserve(&voices, "new-voice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := r.get("old-voice"); ok {
+		t.Fatal("expected least recently used voice to be evicted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old-voice.onnx")); !os.IsNotExist(err) {
+		t.Fatal("expected evicted voice files to be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old-voice.onnx"+evictedFileSuffix)); !os.IsNotExist(err) {
+		t.Fatal("expected evicted voice files to be deleted after being moved aside")
+	}
+	if len(evicted) != 1 || evicted[0] != "old-voice" {
+		t.Fatalf("expected old-voice to be reported as evicted, got %v", evicted)
+	}
+	if _, ok := r.get("recent-voice"); !ok {
+		t.Fatal("expected recently used voice to be kept")
+	}
+}
+
+func TestVoiceRegistry_ReserveKeepsPinnedVoices(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	useVoicesQuota(t, 1, "old-voice", "recent-voice")
+	r := newVoiceRegistry()
+	voices := Voices{
+		"old-voice":    installQuotaVoice(t, r, dir, "old-voice", time.Now().Add(-time.Hour)),
+		"recent-voice": installQuotaVoice(t, r, dir, "recent-voice", time.Now()),
+		"new-voice":    {Key: "new-voice", Files: map[string]File{"en/new-voice.onnx": {SizeBytes: testQuotaFileSize}}},
+	}
+
+	if err := r.reserve(&voices, "new-voice"); err != errVoicesQuotaExceeded {
+		t.Fatalf("expected errVoicesQuotaExceeded, got %v", err)
+	}
+	if len(r.names()) != 2 {
+		t.Fatalf("expected pinned voices to be kept, got %v", r.names())
+	}
+}
+
+func TestPiperToAudioStream_OnDemandDownloadDisabled(t *testing.T) {
+	previous := VOICE_DOWNLOAD_ON_DEMAND
+	VOICE_DOWNLOAD_ON_DEMAND = false
+	defer func() { VOICE_DOWNLOAD_ON_DEMAND = previous }()
+	requests := useVoicesRepo(t, map[string]string{}, nil)
+
+	voices := Voices{"test-voice": testRegistryVoice(md5Hex("model"))}
+	c, w := newTestContext("GET", "/", "")
+	piperToAudioStream(c, TTSRequestInput{Text: "hello", Voice: "test-voice", OutputFormat: "wav"}, &voices, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	if *requests != 0 {
+		t.Fatalf("expected no download, got %d requests", *requests)
+	}
+}
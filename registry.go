@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errVoiceDownloading = errors.New("voice is being downloaded")
+
+// VoiceRegistry tracks the voices installed in VOICES_PATH and when they were
+// last used. Downloads are single-flight: requests for a voice that is
+// already being downloaded wait for that download and share its result.
+type VoiceRegistry struct {
+	mu        sync.RWMutex
+	installed map[string]VoiceDetails
+	downloads map[string]*voiceDownload
+	lastUsed  map[string]time.Time
+	// Bytes that downloads in progress are expected to add to VOICES_PATH
+	reserved map[string]int64
+	// Called with the voices evicted to make room for others
+	onEvict func(voiceName string)
+}
+
+// VoiceFileProgress is the state of a voice file being downloaded. Status is
+// "pending", "downloading", "verified" once its MD5 matched, "existing" when
+// it was already on disk, or "failed".
+type VoiceFileProgress struct {
+	Bytes     int64  `json:"bytes"`
+	SizeBytes int64  `json:"size_bytes"`
+	Status    string `json:"status"`
+}
+
+type voiceDownload struct {
+	done chan struct{}
+	err  error
+
+	mu    sync.Mutex
+	files map[string]VoiceFileProgress
+}
+
+func newVoiceDownload() *voiceDownload {
+	return &voiceDownload{done: make(chan struct{}), files: make(map[string]VoiceFileProgress)}
+}
+
+func (d *voiceDownload) update(fileName string, progress VoiceFileProgress) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.files[fileName] = progress
+}
+
+func (d *voiceDownload) progress() map[string]VoiceFileProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files := make(map[string]VoiceFileProgress, len(d.files))
+	for fileName, progress := range d.files {
+		files[fileName] = progress
+	}
+	return files
+}
+
+var voiceRegistry = newVoiceRegistry()
+
+func newVoiceRegistry() *VoiceRegistry {
+	return &VoiceRegistry{
+		installed: make(map[string]VoiceDetails),
+		downloads: make(map[string]*voiceDownload),
+		lastUsed:  make(map[string]time.Time),
+		reserved:  make(map[string]int64),
+	}
+}
+
+func (r *VoiceRegistry) get(voiceName string) (VoiceDetails, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	details, ok := r.installed[voiceName]
+	return details, ok
+}
+
+func (r *VoiceRegistry) set(voiceName string, details VoiceDetails) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.installed[voiceName] = details
+}
+
+func (r *VoiceRegistry) remove(voiceName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.installed, voiceName)
+	delete(r.lastUsed, voiceName)
+}
+
+// touch marks a voice as used, for the eviction of the least recently used
+// voices.
+func (r *VoiceRegistry) touch(voiceName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastUsed[voiceName] = time.Now()
+}
+
+// names returns the installed voices.
+func (r *VoiceRegistry) names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.installed))
+	for name := range r.installed {
+		names = append(names, name)
+	}
+	return names
+}
+
+// downloading returns the download of a voice, starting it unless one is
+// already in progress. It returns nil when the voice is installed. Downloads
+// run in the background so they complete even if the requests waiting for
+// them go away.
+func (r *VoiceRegistry) downloading(voices *Voices, voiceName string) *voiceDownload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.installed[voiceName]; ok {
+		return nil
+	}
+	if d, ok := r.downloads[voiceName]; ok {
+		return d
+	}
+	d := newVoiceDownload()
+	r.downloads[voiceName] = d
+	go r.run(voices, voiceName, d)
+	return d
+}
+
+func (r *VoiceRegistry) run(voices *Voices, voiceName string, d *voiceDownload) {
+	details, err := VoiceDetails{}, r.reserve(voices, voiceName)
+	if err == nil {
+		details, err = downloadVoiceFiles(voices, voiceName, d.update)
+	}
+
+	r.mu.Lock()
+	if err == nil {
+		r.installed[voiceName] = details
+		r.lastUsed[voiceName] = time.Now()
+	}
+	delete(r.downloads, voiceName)
+	delete(r.reserved, voiceName)
+	d.err = err
+	r.mu.Unlock()
+	close(d.done)
+}
+
+// download installs a voice from the catalog unless it already is.
+func (r *VoiceRegistry) download(voices *Voices, voiceName string) error {
+	d := r.downloading(voices, voiceName)
+	if d == nil {
+		return nil
+	}
+	<-d.done
+	return d.err
+}
+
+// uninstall deletes the files of a voice. It fails with errVoiceDownloading
+// rather than racing with a download of the voice.
+func (r *VoiceRegistry) uninstall(voiceName string, voice Voice) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.downloads[voiceName]; ok {
+		return errVoiceDownloading
+	}
+	delete(r.installed, voiceName)
+	delete(r.lastUsed, voiceName)
+	return deleteVoiceFiles(voice)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const testVoiceConfig = `{"audio":{"sample_rate":16000}}`
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// useVoicesRepo serves files from a fake voices repository, counting requests.
+func useVoicesRepo(t *testing.T, files map[string]string, release <-chan struct{}) *int32 {
+	t.Helper()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if release != nil {
+			<-release
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	t.Cleanup(server.Close)
+	useVoicesMirrors(t, server.URL)
+	return &requests
+}
+
+func testRegistryVoice(modelMD5 string) Voice {
+	return Voice{Files: map[string]File{
+		"en/test-voice.onnx":      {MD5Digest: modelMD5},
+		"en/test-voice.onnx.json": {MD5Digest: md5Hex(testVoiceConfig)},
+	}}
+}
+
+func TestVoiceRegistry_DownloadIsSingleFlight(t *testing.T) {
+	useTempVoicesPath(t)
+	release := make(chan struct{})
+	requests := useVoicesRepo(t, map[string]string{
+		"/en/test-voice.onnx":      "model",
+		"/en/test-voice.onnx.json": testVoiceConfig,
+	}, release)
+	voices := Voices{"test-voice": testRegistryVoice(md5Hex("model"))}
+	r := newVoiceRegistry()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = r.download(&voices, "test-voice")
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(requests); got != 2 {
+		t.Fatalf("expected each file to be downloaded once, got %d requests", got)
+	}
+	if details, ok := r.get("test-voice"); !ok || details.Audio.SampleRate != 16000 {
+		t.Fatalf("expected voice to be installed, got %+v", details)
+	}
+}
+
+func TestVoiceRegistry_DownloadChecksumMismatchLeavesNoFile(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	useVoicesRepo(t, map[string]string{
+		"/en/test-voice.onnx":      "corrupted",
+		"/en/test-voice.onnx.json": testVoiceConfig,
+	}, nil)
+	voices := Voices{"test-voice": testRegistryVoice(md5Hex("model"))}
+	r := newVoiceRegistry()
+
+	if err := r.download(&voices, "test-voice"); err == nil {
+		t.Fatal("expected checksum error")
+	}
+	if _, ok := r.get("test-voice"); ok {
+		t.Fatal("expected voice not to be installed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test-voice.onnx")); !os.IsNotExist(err) {
+		t.Fatal("expected no model file to be left behind")
+	}
+	files, _ := os.ReadDir(dir)
+	for _, file := range files {
+		if file.Name() != "test-voice.onnx.json" {
+			t.Fatalf("unexpected file left behind: %s", file.Name())
+		}
+	}
+}
+
+func TestVoiceRegistry_UninstallDuringDownload(t *testing.T) {
+	r := newVoiceRegistry()
+	r.downloads["test-voice"] = newVoiceDownload()
+	if err := r.uninstall("test-voice", Voice{}); err != errVoiceDownloading {
+		t.Fatalf("expected errVoiceDownloading, got %v", err)
+	}
+}
+
+func TestVoiceRegistry_Uninstall(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	os.WriteFile(filepath.Join(dir, "test-voice.onnx"), []byte("model"), 0644)
+	r := newVoiceRegistry()
+	r.set("test-voice", VoiceDetails{})
+
+	if err := r.uninstall("test-voice", testRegistryVoice("")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := r.get("test-voice"); ok {
+		t.Fatal("expected voice to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test-voice.onnx")); !os.IsNotExist(err) {
+		t.Fatal("expected model file to be deleted")
+	}
+}
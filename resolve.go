@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Maximum number of suggestions returned for a misspelled voice.
+const maxVoiceSuggestions = 5
+
+// VoiceNotFoundError is returned for a voice name that doesn't resolve to a
+// voice, along with the closest voice keys.
+type VoiceNotFoundError struct {
+	Message     string   `json:"error"`
+	Suggestions []string `json:"suggestions"`
+}
+
+func (e *VoiceNotFoundError) Error() string {
+	if len(e.Suggestions) == 0 {
+		return e.Message
+	}
+	return e.Message + ", did you mean " + strings.Join(e.Suggestions, ", ") + "?"
+}
+
+// resolveVoiceName returns the key of the voice a request refers to. Besides
+// exact keys, it accepts keys in any case, aliases from voices.json, and
+// language codes such as de_DE or fr, which pick the default voice of that
+// language. It returns a *VoiceNotFoundError otherwise.
+func resolveVoiceName(voices *Voices, name string) (string, error) {
+	if _, ok := (*voices)[name]; ok {
+		return name, nil
+	}
+	if _, ok := voiceRegistry.get(name); ok {
+		return name, nil
+	}
+
+	keys := make([]string, 0, len(*voices))
+	for key := range *voices {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.EqualFold(key, name) {
+			return key, nil
+		}
+		for _, alias := range (*voices)[key].Aliases {
+			if strings.EqualFold(alias, name) {
+				return key, nil
+			}
+		}
+	}
+
+	if key, ok := languageDefaultVoice(voices, name); ok {
+		return key, nil
+	}
+	return "", &VoiceNotFoundError{Message: "Voice not found: " + name, Suggestions: suggestVoices(keys, name)}
+}
+
+// languageDefaultVoice returns the voice to use for a language code or
+// family: the one set in VOICE_LANGUAGE_DEFAULTS, or else an installed voice
+// of that language, or else its highest quality voice in the catalog.
+func languageDefaultVoice(voices *Voices, language string) (string, bool) {
+	language = strings.ReplaceAll(language, "-", "_")
+	for code, key := range VOICE_LANGUAGE_DEFAULTS {
+		if strings.EqualFold(code, language) {
+			return key, true
+		}
+	}
+
+	var candidates []string
+	for key, voice := range *voices {
+		if strings.EqualFold(voice.Language.Code, language) || strings.EqualFold(voice.Language.Family, language) {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		_, aInstalled := voiceRegistry.get(a)
+		_, bInstalled := voiceRegistry.get(b)
+		if aInstalled != bInstalled {
+			return aInstalled
+		}
+		aQuality, bQuality := voiceQualities[(*voices)[a].Quality], voiceQualities[(*voices)[b].Quality]
+		if aQuality != bQuality {
+			return aQuality > bQuality
+		}
+		return a < b
+	})
+	return candidates[0], true
+}
+
+// suggestVoices returns the keys closest to a misspelled voice name: those
+// within a few edits of it, and those containing it.
+func suggestVoices(keys []string, name string) []string {
+	name = strings.ToLower(name)
+	maxDistance := len(name) / 3
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+
+	distances := make(map[string]int)
+	suggestions := []string{}
+	for _, key := range keys {
+		distance := levenshtein(name, strings.ToLower(key))
+		if distance > maxDistance && (len(name) < 3 || !strings.Contains(strings.ToLower(key), name)) {
+			continue
+		}
+		distances[key] = distance
+		suggestions = append(suggestions, key)
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return distances[suggestions[i]] < distances[suggestions[j]]
+	})
+	if len(suggestions) > maxVoiceSuggestions {
+		suggestions = suggestions[:maxVoiceSuggestions]
+	}
+	return suggestions
+}
+
+// levenshtein returns the edit distance between two strings.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
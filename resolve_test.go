@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testResolveVoices() Voices {
+	voices := testListVoices()
+	amy := voices["en_US-amy-low"]
+	amy.Aliases = []string{"amy"}
+	voices["en_US-amy-low"] = amy
+	voices["de_DE-thorsten-medium"] = Voice{Key: "de_DE-thorsten-medium", Quality: "medium", Language: Language{Code: "de_DE", Family: "de"}}
+	voices["de_DE-thorsten-high"] = Voice{Key: "de_DE-thorsten-high", Quality: "high", Language: Language{Code: "de_DE", Family: "de"}}
+	return voices
+}
+
+func TestResolveVoiceName(t *testing.T) {
+	voices := testResolveVoices()
+	cases := map[string]string{
+		"en_US-amy-low":  "en_US-amy-low",
+		"EN_us-AMY-low":  "en_US-amy-low",
+		"Amy":            "en_US-amy-low",
+		"de_DE":          "de_DE-thorsten-high",
+		"de":             "de_DE-thorsten-high",
+		"fr-FR":          "fr_FR-siwis-x_low",
+		"en_GB":          "en_GB-alan-medium",
+		"registry-voice": "registry-voice",
+	}
+	voiceRegistry.set("registry-voice", VoiceDetails{})
+	defer voiceRegistry.remove("registry-voice")
+
+	for name, want := range cases {
+		got, err := resolveVoiceName(&voices, name)
+		if err != nil || got != want {
+			t.Fatalf("%s: expected %s, got %s (%v)", name, want, got, err)
+		}
+	}
+}
+
+func TestResolveVoiceName_PrefersInstalledAndConfiguredLanguageVoices(t *testing.T) {
+	voices := testResolveVoices()
+	voiceRegistry.set("de_DE-thorsten-medium", VoiceDetails{})
+	defer voiceRegistry.remove("de_DE-thorsten-medium")
+	if got, _ := resolveVoiceName(&voices, "de_DE"); got != "de_DE-thorsten-medium" {
+		t.Fatalf("expected installed voice, got %s", got)
+	}
+
+	previous := VOICE_LANGUAGE_DEFAULTS
+	VOICE_LANGUAGE_DEFAULTS = map[string]string{"en": "en_GB-alan-medium"}
+	defer func() { VOICE_LANGUAGE_DEFAULTS = previous }()
+	if got, _ := resolveVoiceName(&voices, "EN"); got != "en_GB-alan-medium" {
+		t.Fatalf("expected configured voice, got %s", got)
+	}
+}
+
+func TestResolveVoiceName_Suggestions(t *testing.T) {
+	voices := testResolveVoices()
+	_, err := resolveVoiceName(&voices, "en_US-amy-lwo")
+	notFoundErr, ok := err.(*VoiceNotFoundError)
+	if !ok {
+		t.Fatalf("expected *VoiceNotFoundError, got %v", err)
+	}
+	if len(notFoundErr.Suggestions) == 0 || notFoundErr.Suggestions[0] != "en_US-amy-low" {
+		t.Fatalf("unexpected suggestions %v", notFoundErr.Suggestions)
+	}
+
+	_, err = resolveVoiceName(&voices, "thorsten")
+	if got := strings.Join(err.(*VoiceNotFoundError).Suggestions, ","); got != "de_DE-thorsten-high,de_DE-thorsten-medium" {
+		t.Fatalf("unexpected suggestions %q", got)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	if d := levenshtein("kitten", "sitting"); d != 3 {
+		t.Fatalf("expected 3, got %d", d)
+	}
+	if d := levenshtein("", "abc"); d != 3 {
+		t.Fatalf("expected 3, got %d", d)
+	}
+}
+
+func TestPiperToAudioStream_VoiceNotFoundSuggestions(t *testing.T) {
+	voices := testResolveVoices()
+	c, w := newTestContext("GET", "/", "")
+	piperToAudioStream(c, TTSRequestInput{Text: "hello", Voice: "en_US-amy-lw", OutputFormat: "wav"}, &voices, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var body VoiceNotFoundError
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body.Suggestions) == 0 {
+		t.Fatalf("expected suggestions, got %s", w.Body.String())
+	}
+}
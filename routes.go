@@ -2,9 +2,15 @@ package main
 
 import (
 	"embed"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,13 +21,33 @@ import (
 var staticFiles embed.FS
 
 type TTSRequestInput struct {
-	Text         string  `json:"text"`
-	Voice        string  `json:"voice"`
-	Speaker      string  `json:"speaker"`
-	Speed        float64 `json:"speed"`
-	OutputFormat string  `json:"outputFormat"`
+	Text            string   `json:"text"`
+	Voice           string   `json:"voice"`
+	Speaker         string   `json:"speaker"`
+	Speed           float64  `json:"speed"`
+	OutputFormat    string   `json:"outputFormat"`
+	SSML            bool     `json:"ssml"`
+	NoiseScale      *float64 `json:"noiseScale"`
+	NoiseW          *float64 `json:"noiseW"`
+	SentenceSilence *float64 `json:"sentenceSilence"`
+	Preset          string   `json:"preset"`
+	Download        bool     `json:"download"`
+	SampleRate      int      `json:"sampleRate"`
+	Channels        int      `json:"channels"`
+	BitsPerSample   int      `json:"bitsPerSample"`
 }
 
+// Accepted ranges for the piper inference parameters, which take the voice
+// default when unset.
+const (
+	maxNoiseScale      = 2.0
+	maxNoiseW          = 2.0
+	maxSentenceSilence = 10.0
+)
+
+// Sample rates audio can be resampled to, 0 meaning the voice sample rate.
+var outputSampleRates = []int{8000, 11025, 16000, 22050, 24000, 32000, 44100, 48000}
+
 func homeHandler(c *gin.Context) {
 	html, err := staticFiles.ReadFile("static/index.html")
 	if err != nil {
@@ -33,19 +59,222 @@ func homeHandler(c *gin.Context) {
 	c.String(http.StatusOK, string(html))
 }
 
-func voicesHandler(voices *Voices) gin.HandlerFunc {
+func voicesHandler(catalog *VoiceCatalog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		voices := catalog.get()
+		if isVoiceListRequest(c) {
+			listVoicesHandler(c, voices)
+			return
+		}
+		result := make(map[string]VoiceWithDefaults, len(*voices))
+		for key, voice := range *voices {
+			entry := VoiceWithDefaults{Voice: voice}
+			if details, ok := voiceRegistry.get(key); ok {
+				inference := details.Inference
+				entry.Inference = &inference
+			}
+			result[key] = entry
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+var voiceListParameters = []string{"language", "family", "quality", "multiSpeaker", "installed", "q", "sort", "order", "cursor", "limit"}
+
+// isVoiceListRequest tells if GET /api/voices should answer with the list
+// form, the catalog being returned as an object keyed by voice otherwise.
+func isVoiceListRequest(c *gin.Context) bool {
+	for _, key := range voiceListParameters {
+		if _, ok := c.GetQuery(key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func listVoicesHandler(c *gin.Context, voices *Voices) {
+	query := VoiceListQuery{
+		Language:     c.Query("language"),
+		Family:       c.Query("family"),
+		Quality:      c.Query("quality"),
+		MultiSpeaker: getTTSBoolParameter(c, false, "multiSpeaker"),
+		Installed:    getTTSBoolParameter(c, false, "installed"),
+		Search:       c.Query("q"),
+		Sort:         c.DefaultQuery("sort", "key"),
+		Cursor:       c.Query("cursor"),
+		Limit:        defaultVoiceListLimit,
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		c.String(http.StatusBadRequest, "invalid order, must be 'asc' or 'desc'")
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			c.String(http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	entries, next, err := listVoices(voices, query)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	result := gin.H{"voices": entries}
+	if next != "" {
+		result["nextCursor"] = next
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func voiceStatusHandler(catalog *VoiceCatalog) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.JSON(http.StatusOK, voices)
+		voices := catalog.get()
+		key := c.Param("key")
+		voice, ok := (*voices)[key]
+		if !ok {
+			c.String(http.StatusNotFound, "Voice not found")
+			return
+		}
+		c.JSON(http.StatusOK, getVoiceStatus(key, voice))
 	}
 }
 
-func writeWavStreamHttpHeaders(c *gin.Context, sampleRate int, channels int, bitsPerSample int) error {
+// voiceSpeakersHandler returns the speakers of a voice by name, from its
+// config once installed and from the catalog otherwise.
+func voiceSpeakersHandler(catalog *VoiceCatalog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		voices := catalog.get()
+		key := c.Param("key")
+		voice, ok := (*voices)[key]
+		if !ok {
+			c.String(http.StatusNotFound, "Voice not found")
+			return
+		}
+		numSpeakers := voice.NumSpeakers
+		speakers := make(map[string]int)
+		if details, ok := voiceRegistry.get(key); ok {
+			numSpeakers = max(numSpeakers, details.NumSpeakers)
+			for name, id := range details.SpeakerIdMap {
+				speakers[name] = id
+			}
+		} else {
+			for name, id := range voice.SpeakerIDMap {
+				if id, ok := id.(float64); ok {
+					speakers[name] = int(id)
+				}
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"key": key, "num_speakers": max(numSpeakers, len(speakers), 1), "speakers": speakers})
+	}
+}
+
+func voiceDownloadHandler(catalog *VoiceCatalog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		voices := catalog.get()
+		key := c.Param("key")
+		voice, ok := (*voices)[key]
+		if !ok {
+			c.String(http.StatusNotFound, "Voice not found")
+			return
+		}
+		if err := voiceRegistry.download(voices, key); err == errVoicesQuotaExceeded {
+			c.String(http.StatusInsufficientStorage, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("Failed to download voice %s: %v", key, err)
+			c.String(http.StatusBadGateway, "Failed to download voice")
+			return
+		}
+		c.JSON(http.StatusOK, getVoiceStatus(key, voice))
+	}
+}
+
+const voiceDownloadEventsInterval = 250 * time.Millisecond
+
+// voiceDownloadEventsHandler starts downloading a voice if needed and reports
+// its progress as Server-Sent Events: "progress" events with the state of each
+// file, then a "done" or "error" event. Like synthesis requests, it only
+// downloads voices when VOICE_DOWNLOAD_ON_DEMAND is enabled.
+func voiceDownloadEventsHandler(catalog *VoiceCatalog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		voices := catalog.get()
+		key := c.Param("key")
+		if _, ok := (*voices)[key]; !ok {
+			c.String(http.StatusNotFound, "Voice not found")
+			return
+		}
+		if _, installed := voiceRegistry.get(key); !installed && !VOICE_DOWNLOAD_ON_DEMAND {
+			c.String(http.StatusForbidden, errVoiceNotInstalled.Error())
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+
+		download := voiceRegistry.downloading(voices, key)
+		if download == nil {
+			c.SSEvent("done", gin.H{"key": key})
+			return
+		}
+
+		ticker := time.NewTicker(voiceDownloadEventsInterval)
+		defer ticker.Stop()
+		for {
+			c.SSEvent("progress", gin.H{"key": key, "files": download.progress()})
+			c.Writer.Flush()
+			select {
+			case <-download.done:
+				c.SSEvent("progress", gin.H{"key": key, "files": download.progress()})
+				if download.err != nil {
+					c.SSEvent("error", gin.H{"key": key, "error": download.err.Error()})
+				} else {
+					c.SSEvent("done", gin.H{"key": key})
+				}
+				return
+			case <-c.Request.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+func voiceDeleteHandler(catalog *VoiceCatalog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		voices := catalog.get()
+		key := c.Param("key")
+		voice, ok := (*voices)[key]
+		if !ok {
+			c.String(http.StatusNotFound, "Voice not found")
+			return
+		}
+		if err := voiceRegistry.uninstall(key, voice); err == errVoiceDownloading {
+			c.String(http.StatusConflict, "Voice is being downloaded")
+			return
+		} else if err != nil {
+			log.Printf("Failed to delete voice %s: %v", key, err)
+			c.String(http.StatusInternalServerError, "Failed to delete voice")
+			return
+		}
+		if voice.Custom {
+			catalog.removeCustom(key)
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func writeWavStreamHttpHeaders(c *gin.Context, format pcmFormat) error {
 	c.Header("Content-Type", "audio/wav")
 	c.Header("Transfer-Encoding", "chunked")
 	c.Header("Connection", "keep-alive")
 	c.Writer.WriteHeader(http.StatusOK)
 
-	header := generateWAVHeader(sampleRate, channels, bitsPerSample)
+	header := generatePCMWAVHeader(format)
 	if _, err := c.Writer.Write(header); err != nil {
 		return err
 	}
@@ -64,8 +293,9 @@ func getTTSStrParameter(c *gin.Context, postValue string, key string, defaultVal
 	return value
 }
 
-func ttsGetStreamHandler(voices *Voices, r *TTSRequestsStore) gin.HandlerFunc {
+func ttsGetStreamHandler(catalog *VoiceCatalog, r *TTSRequestsStore, pool *PiperPool, cache *AudioCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		voices := catalog.get()
 		streamId := c.Param("streamId")
 		ttsRequest, ok := r.get(streamId)
 		if !ok {
@@ -77,7 +307,7 @@ func ttsGetStreamHandler(voices *Voices, r *TTSRequestsStore) gin.HandlerFunc {
 			c.String(http.StatusNotFound, "Stream not found")
 			return
 		}
-		piperToAudioStream(c, ttsRequest.Request, voices)
+		cachedAudioStream(c, ttsRequest.Request, voices, pool, cache)
 	}
 }
 
@@ -95,8 +325,8 @@ func ttsPostStreamHandler(r *TTSRequestsStore) gin.HandlerFunc {
 			c.String(http.StatusBadRequest, "text query parameter is required")
 			return
 		}
-		if ttsRequestInput.OutputFormat == "mp3" {
-			c.String(http.StatusBadRequest, "outputFormat 'mp3' is not supported on stream endpoints")
+		if err := validateOutputFormat(ttsRequestInput.OutputFormat); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
 			return
 		}
 		entry := TTSRequestStore{
@@ -125,6 +355,40 @@ func getTTSFloatParameter(c *gin.Context, postValue float64, key string, default
 	return value
 }
 
+// getTTSOptionalFloatParameter is getTTSFloatParameter for parameters where 0
+// is a valid value, nil meaning unset.
+func getTTSOptionalFloatParameter(c *gin.Context, postValue *float64, key string, defaultValue *float64) *float64 {
+	if postValue != nil {
+		return postValue
+	}
+	if parsedValue, err := strconv.ParseFloat(c.Query(key), 64); err == nil {
+		return &parsedValue
+	}
+	return defaultValue
+}
+
+func getTTSIntParameter(c *gin.Context, postValue int, key string, defaultValue int) int {
+	value := postValue
+	if value == 0 {
+		parsedValue, err := strconv.Atoi(c.Query(key))
+		if err == nil {
+			value = parsedValue
+		}
+	}
+	if value == 0 {
+		value = defaultValue
+	}
+	return value
+}
+
+func getTTSBoolParameter(c *gin.Context, postValue bool, key string) bool {
+	if postValue {
+		return true
+	}
+	value, err := strconv.ParseBool(c.Query(key))
+	return err == nil && value
+}
+
 func getTTSRequestInput(c *gin.Context) (TTSRequestInput, error) {
 	var ttsRequestInput TTSRequestInput
 
@@ -134,69 +398,323 @@ func getTTSRequestInput(c *gin.Context) (TTSRequestInput, error) {
 		}
 	}
 
-	ttsRequestInput.Voice = getTTSStrParameter(c, ttsRequestInput.Voice, "voice", "en_US-amy-low")
-	ttsRequestInput.Speaker = getTTSStrParameter(c, ttsRequestInput.Speaker, "speaker", "")
-	ttsRequestInput.Speed = getTTSFloatParameter(c, ttsRequestInput.Speed, "speed", 1.0)
+	return applyTTSRequestDefaults(c, ttsRequestInput), nil
+}
+
+// applyTTSRequestDefaults fills values missing from the JSON body with query
+// parameters, then with the values of the requested preset, then defaults.
+// Unknown presets are reported by planTTS.
+func applyTTSRequestDefaults(c *gin.Context, ttsRequestInput TTSRequestInput) TTSRequestInput {
+	ttsRequestInput.Preset = getTTSStrParameter(c, ttsRequestInput.Preset, "preset", "")
+	preset := ttsPresets[ttsRequestInput.Preset]
+	ttsRequestInput.Voice = getTTSStrParameter(c, ttsRequestInput.Voice, "voice", presetDefault(preset.Voice, DEFAULT_VOICE))
+	ttsRequestInput.Speaker = getTTSStrParameter(c, ttsRequestInput.Speaker, "speaker", preset.Speaker)
+	ttsRequestInput.Speed = getTTSFloatParameter(c, ttsRequestInput.Speed, "speed", presetDefault(preset.Speed, 1.0))
 	ttsRequestInput.Text = getTTSStrParameter(c, ttsRequestInput.Text, "text", "")
-	ttsRequestInput.OutputFormat = getTTSStrParameter(c, ttsRequestInput.OutputFormat, "outputFormat", "wav")
+	ttsRequestInput.OutputFormat = getTTSStrParameter(c, ttsRequestInput.OutputFormat, "outputFormat", presetDefault(preset.OutputFormat, "wav"))
+	ttsRequestInput.SSML = getTTSBoolParameter(c, ttsRequestInput.SSML || preset.SSML, "ssml")
+	ttsRequestInput.NoiseScale = getTTSOptionalFloatParameter(c, ttsRequestInput.NoiseScale, "noiseScale", preset.NoiseScale)
+	ttsRequestInput.NoiseW = getTTSOptionalFloatParameter(c, ttsRequestInput.NoiseW, "noiseW", preset.NoiseW)
+	ttsRequestInput.SentenceSilence = getTTSOptionalFloatParameter(c, ttsRequestInput.SentenceSilence, "sentenceSilence", preset.SentenceSilence)
+	ttsRequestInput.SampleRate = getTTSIntParameter(c, ttsRequestInput.SampleRate, "sampleRate", preset.SampleRate)
+	ttsRequestInput.Channels = getTTSIntParameter(c, ttsRequestInput.Channels, "channels", preset.Channels)
+	ttsRequestInput.BitsPerSample = getTTSIntParameter(c, ttsRequestInput.BitsPerSample, "bitsPerSample", preset.BitsPerSample)
+	ttsRequestInput.Download = getTTSBoolParameter(c, ttsRequestInput.Download, "download")
+	return ttsRequestInput
+}
+
+// inRange reports whether an optional parameter is unset or between 0 and max.
+func inRange(value *float64, max float64) bool {
+	return value == nil || (*value >= 0 && *value <= max)
+}
+
+// validateOutputFormat checks that an output format is one of
+// outputContentTypes.
+func validateOutputFormat(outputFormat string) error {
+	if _, ok := outputContentTypes[outputFormat]; ok {
+		return nil
+	}
+	formats := make([]string, 0, len(outputContentTypes))
+	for format := range outputContentTypes {
+		formats = append(formats, "'"+format+"'")
+	}
+	sort.Strings(formats)
+	return fmt.Errorf("invalid outputFormat, must be one of %s", strings.Join(formats, ", "))
+}
+
+// validateOutputPCMFormat checks the sampleRate, channels and bitsPerSample
+// of a request and returns the PCM format they describe for a voice.
+// Channels and sample sizes other than piper's only apply to WAV output.
+func validateOutputPCMFormat(ttsRequestInput TTSRequestInput, voiceSampleRate int) (pcmFormat, error) {
+	format := pcmFormat{SampleRate: voiceSampleRate, Channels: 1, BitsPerSample: 16}
+	if ttsRequestInput.SampleRate != 0 {
+		format.SampleRate = ttsRequestInput.SampleRate
+	}
+	if ttsRequestInput.Channels != 0 {
+		format.Channels = ttsRequestInput.Channels
+	}
+	if ttsRequestInput.BitsPerSample != 0 {
+		format.BitsPerSample = ttsRequestInput.BitsPerSample
+	}
+
+	if ttsRequestInput.SampleRate != 0 && !slices.Contains(outputSampleRates, ttsRequestInput.SampleRate) {
+		rates := make([]string, len(outputSampleRates))
+		for i, rate := range outputSampleRates {
+			rates[i] = strconv.Itoa(rate)
+		}
+		return format, fmt.Errorf("invalid sampleRate, must be one of %s", strings.Join(rates, ", "))
+	}
+	if format.Channels != 1 && format.Channels != 2 {
+		return format, errors.New("invalid channels, must be 1 or 2")
+	}
+	if !slices.Contains([]int{8, 16, 24, 32}, format.BitsPerSample) {
+		return format, errors.New("invalid bitsPerSample, must be 8, 16, 24 or 32")
+	}
+	if ttsRequestInput.OutputFormat != "wav" && (format.Channels != 1 || format.BitsPerSample != 16) {
+		return format, errors.New("channels and bitsPerSample are only supported with the wav outputFormat")
+	}
+	if _, ok := g711Formats[ttsRequestInput.OutputFormat]; ok && ttsRequestInput.SampleRate != 0 && ttsRequestInput.SampleRate != g711SampleRate {
+		return format, fmt.Errorf("invalid sampleRate, %s output is always %d Hz", ttsRequestInput.OutputFormat, g711SampleRate)
+	}
+	return format, nil
+}
 
-	return ttsRequestInput, nil
+// ttsPlan is a validated request, ready to be synthesized.
+type ttsPlan struct {
+	Segments     []ttsSegment
+	SampleRate   int
+	OutputFormat string
+	// Format the raw audio at SampleRate is converted to
+	Output pcmFormat
 }
 
-func piperToAudioStream(c *gin.Context, ttsRequestInput TTSRequestInput, voices *Voices) {
+// planTTS validates a request and resolves its voices into the segments to
+// synthesize. Errors are client errors, *SSMLError for invalid SSML and
+// *VoiceNotFoundError for unknown voices, except for errVoiceNotInstalled and
+// errVoicesQuotaExceeded.
+func planTTS(ttsRequestInput TTSRequestInput, voices *Voices) (ttsPlan, error) {
 	if ttsRequestInput.Text == "" {
-		c.String(http.StatusBadRequest, "text query parameter is required")
-		return
+		return ttsPlan{}, errors.New("text query parameter is required")
 	}
 
-	if ttsRequestInput.OutputFormat != "wav" && ttsRequestInput.OutputFormat != "mp3" {
-		c.String(http.StatusBadRequest, "invalid outputFormat, must be 'wav' or 'mp3'")
-		return
+	if _, ok := ttsPresets[ttsRequestInput.Preset]; ttsRequestInput.Preset != "" && !ok {
+		return ttsPlan{}, fmt.Errorf("unknown preset: %s", ttsRequestInput.Preset)
+	}
+
+	if err := validateOutputFormat(ttsRequestInput.OutputFormat); err != nil {
+		return ttsPlan{}, err
+	}
+
+	if !inRange(ttsRequestInput.NoiseScale, maxNoiseScale) {
+		return ttsPlan{}, fmt.Errorf("invalid noiseScale, must be between 0 and %v", maxNoiseScale)
+	}
+	if !inRange(ttsRequestInput.NoiseW, maxNoiseW) {
+		return ttsPlan{}, fmt.Errorf("invalid noiseW, must be between 0 and %v", maxNoiseW)
+	}
+	if !inRange(ttsRequestInput.SentenceSilence, maxSentenceSilence) {
+		return ttsPlan{}, fmt.Errorf("invalid sentenceSilence, must be between 0 and %v seconds", maxSentenceSilence)
 	}
 
+	voiceName, err := resolveVoiceName(voices, ttsRequestInput.Voice)
+	if err != nil {
+		return ttsPlan{}, err
+	}
+	ttsRequestInput.Voice = voiceName
 	voice, err := getVoiceDetails(voices, ttsRequestInput.Voice)
+	if err == errVoiceNotInstalled || err == errVoicesQuotaExceeded {
+		return ttsPlan{}, err
+	} else if err != nil {
+		return ttsPlan{}, errors.New("Voice not found")
+	}
+	speaker, err := resolveSpeaker(voice, ttsRequestInput.Speaker)
 	if err != nil {
-		c.String(http.StatusBadRequest, "Voice not found")
+		return ttsPlan{}, err
+	}
+
+	output, err := validateOutputPCMFormat(ttsRequestInput, voice.Audio.SampleRate)
+	if err != nil {
+		return ttsPlan{}, err
+	}
+
+	plan := ttsPlan{SampleRate: voice.Audio.SampleRate, OutputFormat: ttsRequestInput.OutputFormat, Output: output}
+	config := piperConfig{
+		Voice:       ttsRequestInput.Voice,
+		Speaker:     speaker,
+		LengthScale: speedToLengthScale(ttsRequestInput.Speed),
+	}
+	params := inferenceParameters{
+		NoiseScale:      ttsRequestInput.NoiseScale,
+		NoiseW:          ttsRequestInput.NoiseW,
+		SentenceSilence: ttsRequestInput.SentenceSilence,
+	}
+	if ttsRequestInput.SSML {
+		plan.Segments, err = ssmlToSegments(ttsRequestInput.Text, voices, config, params, ttsRequestInput.Speed)
+		if err != nil {
+			return ttsPlan{}, err
+		}
+	} else {
+		plan.Segments = []ttsSegment{{
+			Config:   applyInferenceDefaults(config, params, voice),
+			Text:     ttsRequestInput.Text,
+			Language: (*voices)[ttsRequestInput.Voice].Language.Code,
+		}}
+	}
+	return plan, nil
+}
+
+func writeTTSPlanError(c *gin.Context, err error) {
+	if ssmlErr, ok := err.(*SSMLError); ok {
+		c.JSON(voiceErrorStatus(ssmlErr.Err, http.StatusBadRequest), ssmlErr)
 		return
 	}
-	speaker, ok := voice.SpeakerIdMap[ttsRequestInput.Speaker]
-	if !ok {
-		speaker = 0
+	if notFoundErr, ok := err.(*VoiceNotFoundError); ok {
+		c.JSON(http.StatusBadRequest, notFoundErr)
+		return
+	}
+	c.String(voiceErrorStatus(err, http.StatusBadRequest), err.Error())
+}
+
+// voiceErrorStatus returns the HTTP status of an error getting a voice ready.
+func voiceErrorStatus(err error, defaultStatus int) int {
+	switch err {
+	case errVoiceNotInstalled:
+		return http.StatusForbidden
+	case errVoicesQuotaExceeded:
+		return http.StatusInsufficientStorage
+	}
+	return defaultStatus
+}
+
+func piperToAudioStream(c *gin.Context, ttsRequestInput TTSRequestInput, voices *Voices, pool *PiperPool) {
+	plan, err := planTTS(ttsRequestInput, voices)
+	if err != nil {
+		writeTTSPlanError(c, err)
+		return
+	}
+	streamTTSPlan(c, ttsRequestInput, plan, pool)
+}
+
+// streamTTSPlan synthesizes a planned request and streams its audio.
+func streamTTSPlan(c *gin.Context, ttsRequestInput TTSRequestInput, plan ttsPlan, pool *PiperPool) {
+	if logInput {
+		fmt.Println(strconv.Quote(ttsRequestInput.Text))
 	}
 
-	sampleRate := voice.Audio.SampleRate
-	lengthScale := speedToLengthScale(ttsRequestInput.Speed)
-	channels := 1
-	bitsPerSample := 16
+	audio := newSegmentStream(c.Request.Context(), pool, plan.Segments, plan.SampleRate)
+	defer audio.Close()
 
-	if ttsRequestInput.OutputFormat == "mp3" {
-		if err := streamTTSAsMp3(c, ttsRequestInput.Voice, speaker, ttsRequestInput.Text, sampleRate, lengthScale); err != nil {
-			log.Printf("Error streaming MP3 TTS: %v", err)
+	if _, ok := ffmpegFormats[plan.OutputFormat]; ok {
+		if err := streamTTSWithFfmpeg(c, pool, newResampler(audio, plan.SampleRate, plan.Output.SampleRate), plan.OutputFormat, plan.Output.SampleRate); err != nil {
+			log.Printf("Error streaming %s TTS: %v", plan.OutputFormat, err)
 		}
 		return
 	}
+	if plan.OutputFormat == "flac" {
+		streamTTSWithFLAC(c, newResampler(audio, plan.SampleRate, plan.Output.SampleRate), plan.Output.SampleRate)
+		return
+	}
+	if _, ok := g711Formats[plan.OutputFormat]; ok {
+		streamTTSWithG711(c, audio, plan.SampleRate, plan.OutputFormat)
+		return
+	}
 
-	err = writeWavStreamHttpHeaders(c, sampleRate, channels, bitsPerSample)
+	err := writeWavStreamHttpHeaders(c, plan.Output)
 	if err != nil {
 		log.Printf("error writting http headers: %v", err)
 		c.String(http.StatusInternalServerError, "Error streaming TTS")
 		return
 	}
 
-	err = streamTTS(c, ttsRequestInput.Voice, speaker, ttsRequestInput.Text, sampleRate, channels, bitsPerSample, lengthScale)
+	streamWavData(c, convertPCM(audio, plan.SampleRate, plan.Output))
+}
+
+// piperToAudioDownload synthesizes the whole audio of a request before
+// answering, so that the response has a Content-Length, WAV and FLAC headers
+// hold the actual sizes, and Range requests can seek. The file is saved to
+// the cache when there is one.
+func piperToAudioDownload(c *gin.Context, ttsRequestInput TTSRequestInput, voices *Voices, pool *PiperPool, cache *AudioCache) {
+	plan, err := planTTS(ttsRequestInput, voices)
 	if err != nil {
-		log.Printf("Error streaming TTS: %v", err)
-		c.String(http.StatusInternalServerError, "Error streaming TTS")
+		writeTTSPlanError(c, err)
+		return
+	}
+	name := audioCacheKey(plan, voices, true)
+	if cache != nil {
+		if file, ok := cache.open(name); ok {
+			defer file.Close()
+			serveAudioDownload(c, file, plan.OutputFormat)
+			return
+		}
+	}
+
+	if logInput {
+		fmt.Println(strconv.Quote(ttsRequestInput.Text))
+	}
+
+	var file *os.File
+	if cache != nil {
+		file, err = cache.create()
+	} else {
+		file, err = os.CreateTemp("", audioCacheTempPrefix)
+	}
+	if err != nil {
+		log.Printf("Failed to create audio file: %v", err)
+		c.String(http.StatusInternalServerError, "Error generating TTS")
+		return
+	}
+
+	audio := newSegmentStream(c.Request.Context(), pool, plan.Segments, plan.SampleRate)
+	err = writeAudioFile(pool, file, audio, plan)
+	audio.Close()
+	if err == nil {
+		err = c.Request.Context().Err()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		log.Printf("Error generating TTS: %v", err)
+		c.String(http.StatusInternalServerError, "Error generating TTS")
+		return
+	}
+
+	serveAudioDownload(c, file, plan.OutputFormat)
+	if cache == nil {
+		file.Close()
+		os.Remove(file.Name())
+	} else if err := cache.commit(file, name); err != nil {
+		log.Printf("Failed to save audio to cache: %v", err)
+	}
+}
+
+// serveAudioDownload writes a complete audio file as an attachment.
+func serveAudioDownload(c *gin.Context, file *os.File, outputFormat string) {
+	info, err := file.Stat()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Error reading audio")
+		return
+	}
+	c.Header("Content-Type", outputContentTypes[outputFormat])
+	c.Header("Content-Disposition", `attachment; filename="`+downloadFileName(outputFormat)+`"`)
+	http.ServeContent(c.Writer, c.Request, "", info.ModTime(), file)
+}
+
+// downloadFileName returns the file name of downloaded audio, G.711 audio in
+// a WAV file getting the .wav extension.
+func downloadFileName(outputFormat string) string {
+	if _, container, ok := strings.Cut(outputFormat, "-"); ok {
+		outputFormat = container
 	}
+	return "speech." + outputFormat
 }
 
-func ttsHandler(voices *Voices) gin.HandlerFunc {
+func ttsHandler(catalog *VoiceCatalog, pool *PiperPool, cache *AudioCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		voices := catalog.get()
 		ttsRequestInput, err := getTTSRequestInput(c)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request, JSON body required"})
 			return
 		}
-		piperToAudioStream(c, ttsRequestInput, voices)
+		cachedAudioStream(c, ttsRequestInput, voices, pool, cache)
 	}
 }
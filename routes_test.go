@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -133,7 +136,7 @@ func TestGetTTSRequestInput_POST_JSONBody(t *testing.T) {
 func TestPiperToAudioStream_EmptyText(t *testing.T) {
 	voices := Voices{}
 	c, w := newTestContext("GET", "/", "")
-	piperToAudioStream(c, TTSRequestInput{Text: "", OutputFormat: "wav"}, &voices)
+	piperToAudioStream(c, TTSRequestInput{Text: "", OutputFormat: "wav"}, &voices, nil)
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("expected 400, got %d", w.Code)
 	}
@@ -145,7 +148,7 @@ func TestPiperToAudioStream_EmptyText(t *testing.T) {
 func TestPiperToAudioStream_InvalidFormat(t *testing.T) {
 	voices := Voices{}
 	c, w := newTestContext("GET", "/", "")
-	piperToAudioStream(c, TTSRequestInput{Text: "hello", OutputFormat: "ogg"}, &voices)
+	piperToAudioStream(c, TTSRequestInput{Text: "hello", OutputFormat: "ogg"}, &voices, nil)
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("expected 400, got %d", w.Code)
 	}
@@ -157,7 +160,7 @@ func TestPiperToAudioStream_InvalidFormat(t *testing.T) {
 func TestPiperToAudioStream_VoiceNotFound(t *testing.T) {
 	voices := Voices{}
 	c, w := newTestContext("GET", "/", "")
-	piperToAudioStream(c, TTSRequestInput{Text: "hello", Voice: "does-not-exist", OutputFormat: "wav"}, &voices)
+	piperToAudioStream(c, TTSRequestInput{Text: "hello", Voice: "does-not-exist", OutputFormat: "wav"}, &voices, nil)
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("expected 400, got %d", w.Code)
 	}
@@ -169,7 +172,7 @@ func TestPiperToAudioStream_VoiceNotFound(t *testing.T) {
 func TestTTSHandler_InvalidJSON(t *testing.T) {
 	voices := Voices{}
 	c, w := newTestContext("POST", "/api/tts", "{not valid json")
-	ttsHandler(&voices)(c)
+	ttsHandler(newVoiceCatalog(voices), nil, nil)(c)
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("expected 400, got %d", w.Code)
 	}
@@ -183,7 +186,7 @@ func TestVoicesHandler_ReturnsJSON(t *testing.T) {
 		"en_US-amy-low": Voice{Key: "en_US-amy-low", Name: "amy"},
 	}
 	c, w := newTestContext("GET", "/api/voices", "")
-	voicesHandler(&voices)(c)
+	voicesHandler(newVoiceCatalog(voices))(c)
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", w.Code)
 	}
@@ -199,7 +202,7 @@ func TestVoicesHandler_ReturnsJSON(t *testing.T) {
 func TestVoicesHandler_EmptyVoices(t *testing.T) {
 	voices := Voices{}
 	c, w := newTestContext("GET", "/api/voices", "")
-	voicesHandler(&voices)(c)
+	voicesHandler(newVoiceCatalog(voices))(c)
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", w.Code)
 	}
@@ -221,7 +224,7 @@ func TestHomeHandler_ReturnsHTML(t *testing.T) {
 
 func TestWriteWavStreamHttpHeaders_Headers(t *testing.T) {
 	c, w := newTestContext("GET", "/", "")
-	err := writeWavStreamHttpHeaders(c, 22050, 1, 16)
+	err := writeWavStreamHttpHeaders(c, pcmFormat{SampleRate: 22050, Channels: 1, BitsPerSample: 16})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -248,15 +251,26 @@ func TestTTSPostStreamHandler_MissingText(t *testing.T) {
 	}
 }
 
-func TestTTSPostStreamHandler_Mp3Rejected(t *testing.T) {
+func TestTTSPostStreamHandler_UnknownFormatRejected(t *testing.T) {
 	r := initTTSRequestsStore()
-	c, w := newTestContext("POST", "/api/tts/stream", `{"text":"hello","outputFormat":"mp3"}`)
+	c, w := newTestContext("POST", "/api/tts/stream", `{"text":"hello","outputFormat":"aac"}`)
 	ttsPostStreamHandler(r)(c)
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("expected 400, got %d", w.Code)
 	}
-	if !strings.Contains(w.Body.String(), "mp3") {
-		t.Fatalf("expected mp3 rejection message, got %q", w.Body.String())
+	if !strings.Contains(w.Body.String(), "invalid outputFormat") {
+		t.Fatalf("expected format rejection message, got %q", w.Body.String())
+	}
+}
+
+func TestTTSPostStreamHandler_FfmpegFormatsAccepted(t *testing.T) {
+	r := initTTSRequestsStore()
+	for _, format := range []string{"mp3", "opus"} {
+		c, w := newTestContext("POST", "/api/tts/stream", `{"text":"hello","outputFormat":"`+format+`"}`)
+		ttsPostStreamHandler(r)(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", format, w.Code)
+		}
 	}
 }
 
@@ -305,7 +319,7 @@ func TestTTSGetStreamHandler_NotFound(t *testing.T) {
 	r := initTTSRequestsStore()
 	c, w := newTestContext("GET", "/api/tts/stream/unknown-id", "")
 	c.Params = gin.Params{{Key: "streamId", Value: "unknown-id"}}
-	ttsGetStreamHandler(&voices, r)(c)
+	ttsGetStreamHandler(newVoiceCatalog(voices), r, nil, nil)(c)
 	if w.Code != http.StatusNotFound {
 		t.Fatalf("expected 404, got %d", w.Code)
 	}
@@ -323,7 +337,7 @@ func TestTTSGetStreamHandler_ExpiredStream(t *testing.T) {
 	})
 	c, w := newTestContext("GET", "/api/tts/stream/expired-id", "")
 	c.Params = gin.Params{{Key: "streamId", Value: "expired-id"}}
-	ttsGetStreamHandler(&voices, r)(c)
+	ttsGetStreamHandler(newVoiceCatalog(voices), r, nil, nil)(c)
 	if w.Code != http.StatusNotFound {
 		t.Fatalf("expected 404, got %d", w.Code)
 	}
@@ -331,3 +345,373 @@ func TestTTSGetStreamHandler_ExpiredStream(t *testing.T) {
 		t.Fatal("expected expired entry to be deleted from store")
 	}
 }
+
+func TestGetTTSRequestInput_GET_InferenceParams(t *testing.T) {
+	c, _ := newTestContext("GET", "/?text=hello&noiseScale=0.5&noiseW=0.6&sentenceSilence=0.4", "")
+	input, err := getTTSRequestInput(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *input.NoiseScale != 0.5 || *input.NoiseW != 0.6 || *input.SentenceSilence != 0.4 {
+		t.Fatalf("unexpected inference params %+v", input)
+	}
+}
+
+func TestGetTTSRequestInput_ExplicitZeroInferenceParams(t *testing.T) {
+	c, _ := newTestContext("POST", "/?noiseW=0", `{"text":"hello","noiseScale":0}`)
+	input, err := getTTSRequestInput(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if input.NoiseScale == nil || *input.NoiseScale != 0 || input.NoiseW == nil || *input.NoiseW != 0 {
+		t.Fatalf("expected explicit zero inference params, got %+v", input)
+	}
+	if input.SentenceSilence != nil {
+		t.Fatalf("expected unset sentence silence, got %v", *input.SentenceSilence)
+	}
+}
+
+func TestPiperToAudioStream_NoiseScaleOutOfRange(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("GET", "/", "")
+	piperToAudioStream(c, TTSRequestInput{Text: "hello", OutputFormat: "wav", NoiseScale: floatPtr(3)}, &voices, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "invalid noiseScale") {
+		t.Fatalf("expected noiseScale error, got %q", w.Body.String())
+	}
+}
+
+func TestVoicesHandler_IncludesInferenceDefaults(t *testing.T) {
+	voices := Voices{
+		"test-inference-voice": Voice{Key: "test-inference-voice"},
+		"test-missing-voice":   Voice{Key: "test-missing-voice"},
+	}
+	voiceRegistry.set("test-inference-voice", VoiceDetails{Inference: VoiceDetailsInference{NoiseScale: 0.5, LengthScale: 1, NoiseW: 0.7, SentenceSilence: 0.2}})
+	defer voiceRegistry.remove("test-inference-voice")
+
+	c, w := newTestContext("GET", "/api/voices", "")
+	voicesHandler(newVoiceCatalog(voices))(c)
+	var result map[string]VoiceWithDefaults
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("response is not valid JSON: %v", err)
+	}
+	if inference := result["test-inference-voice"].Inference; inference == nil || inference.NoiseW != 0.7 {
+		t.Fatalf("expected inference defaults for downloaded voice, got %+v", inference)
+	}
+	if result["test-missing-voice"].Inference != nil {
+		t.Fatal("expected no inference defaults for a voice that is not downloaded")
+	}
+}
+
+func TestVoiceStatusHandler_NotFound(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("GET", "/api/voices/missing", "")
+	c.Params = gin.Params{{Key: "key", Value: "missing"}}
+	voiceStatusHandler(newVoiceCatalog(voices))(c)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestVoiceDownloadHandler_NotFound(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("POST", "/api/voices/missing/download", "")
+	c.Params = gin.Params{{Key: "key", Value: "missing"}}
+	voiceDownloadHandler(newVoiceCatalog(voices))(c)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestVoiceDeleteHandler_Deletes(t *testing.T) {
+	useTempVoicesPath(t)
+	voices := Voices{"test-delete-voice": {Files: map[string]File{"en/v.onnx": {}}}}
+	voiceRegistry.set("test-delete-voice", VoiceDetails{})
+	defer voiceRegistry.remove("test-delete-voice")
+
+	c, _ := newTestContext("DELETE", "/api/voices/test-delete-voice", "")
+	c.Params = gin.Params{{Key: "key", Value: "test-delete-voice"}}
+	voiceDeleteHandler(newVoiceCatalog(voices))(c)
+	if c.Writer.Status() != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", c.Writer.Status())
+	}
+	if _, ok := voiceRegistry.get("test-delete-voice"); ok {
+		t.Fatal("expected voice to be removed")
+	}
+}
+
+func TestVoiceDownloadEventsHandler_ReportsProgress(t *testing.T) {
+	useTempVoicesPath(t)
+	useVoicesRepo(t, map[string]string{
+		"/en/test-voice.onnx":      "model",
+		"/en/test-voice.onnx.json": testVoiceConfig,
+	}, nil)
+	voices := Voices{"test-voice": testRegistryVoice(md5Hex("model"))}
+	defer voiceRegistry.remove("test-voice")
+
+	c, w := newTestContext("GET", "/api/voices/test-voice/download/events", "")
+	c.Params = gin.Params{{Key: "key", Value: "test-voice"}}
+	voiceDownloadEventsHandler(newVoiceCatalog(voices))(c)
+
+	body := w.Body.String()
+	if !strings.Contains(body, "event:progress") || !strings.Contains(body, `"status":"verified"`) {
+		t.Fatalf("expected progress events, got %q", body)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(body), `data:{"key":"test-voice"}`) || !strings.Contains(body, "event:done") {
+		t.Fatalf("expected a final done event, got %q", body)
+	}
+}
+
+func TestVoiceDownloadEventsHandler_AlreadyInstalled(t *testing.T) {
+	voices := Voices{"test-events-installed": {}}
+	voiceRegistry.set("test-events-installed", VoiceDetails{})
+	defer voiceRegistry.remove("test-events-installed")
+
+	c, w := newTestContext("GET", "/api/voices/test-events-installed/download/events", "")
+	c.Params = gin.Params{{Key: "key", Value: "test-events-installed"}}
+	voiceDownloadEventsHandler(newVoiceCatalog(voices))(c)
+	if body := w.Body.String(); !strings.HasPrefix(body, "event:done") {
+		t.Fatalf("expected a done event, got %q", body)
+	}
+}
+
+func TestVoiceDownloadEventsHandler_OnDemandDownloadDisabled(t *testing.T) {
+	previous := VOICE_DOWNLOAD_ON_DEMAND
+	VOICE_DOWNLOAD_ON_DEMAND = false
+	defer func() { VOICE_DOWNLOAD_ON_DEMAND = previous }()
+	requests := useVoicesRepo(t, map[string]string{}, nil)
+	voices := Voices{"test-voice": testRegistryVoice(md5Hex("model"))}
+
+	c, w := newTestContext("GET", "/api/voices/test-voice/download/events", "")
+	c.Params = gin.Params{{Key: "key", Value: "test-voice"}}
+	voiceDownloadEventsHandler(newVoiceCatalog(voices))(c)
+	if w.Code != http.StatusForbidden || w.Body.String() != errVoiceNotInstalled.Error() {
+		t.Fatalf("expected 403, got %d: %q", w.Code, w.Body.String())
+	}
+	if *requests != 0 {
+		t.Fatalf("expected no download, got %d requests", *requests)
+	}
+}
+
+func TestVoicesHandler_ListForm(t *testing.T) {
+	voices := Voices{
+		"en_US-amy-low":     {Key: "en_US-amy-low", Language: Language{Code: "en_US"}},
+		"fr_FR-siwis-x_low": {Key: "fr_FR-siwis-x_low", Language: Language{Code: "fr_FR"}},
+	}
+	c, w := newTestContext("GET", "/api/voices?language=en_US&limit=1", "")
+	voicesHandler(newVoiceCatalog(voices))(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result struct {
+		Voices     []VoiceListEntry `json:"voices"`
+		NextCursor string           `json:"nextCursor"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("response is not valid JSON: %v", err)
+	}
+	if len(result.Voices) != 1 || result.Voices[0].Key != "en_US-amy-low" || result.NextCursor != "" {
+		t.Fatalf("unexpected list %+v", result)
+	}
+}
+
+func TestVoicesHandler_ListInvalidSort(t *testing.T) {
+	c, w := newTestContext("GET", "/api/voices?sort=size", "")
+	voicesHandler(newVoiceCatalog(Voices{}))(c)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestPiperToAudioStream_InvalidSpeaker(t *testing.T) {
+	voiceRegistry.set("test-speaker-voice", VoiceDetails{NumSpeakers: 2, SpeakerIdMap: map[string]int{"a": 0, "b": 1}})
+	defer voiceRegistry.remove("test-speaker-voice")
+	voices := Voices{}
+	c, w := newTestContext("GET", "/", "")
+	piperToAudioStream(c, TTSRequestInput{Text: "hello", Voice: "test-speaker-voice", Speaker: "5", OutputFormat: "wav"}, &voices, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "invalid speaker") {
+		t.Fatalf("expected speaker error, got %q", w.Body.String())
+	}
+}
+
+func TestVoiceSpeakersHandler(t *testing.T) {
+	voices := Voices{"multi": {Key: "multi", NumSpeakers: 2, SpeakerIDMap: map[string]interface{}{"a": 0.0, "b": 1.0}}}
+	c, w := newTestContext("GET", "/api/voices/multi/speakers", "")
+	c.Params = gin.Params{{Key: "key", Value: "multi"}}
+	voiceSpeakersHandler(newVoiceCatalog(voices))(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var body struct {
+		NumSpeakers int            `json:"num_speakers"`
+		Speakers    map[string]int `json:"speakers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.NumSpeakers != 2 || body.Speakers["b"] != 1 {
+		t.Fatalf("unexpected body %s", w.Body.String())
+	}
+
+	c, w = newTestContext("GET", "/api/voices/missing/speakers", "")
+	c.Params = gin.Params{{Key: "key", Value: "missing"}}
+	voiceSpeakersHandler(newVoiceCatalog(voices))(c)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestGetTTSRequestInput_GET_OutputPCMParams(t *testing.T) {
+	c, _ := newTestContext("GET", "/?text=hello&sampleRate=48000&channels=2&bitsPerSample=24", "")
+	input, err := getTTSRequestInput(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if input.SampleRate != 48000 || input.Channels != 2 || input.BitsPerSample != 24 {
+		t.Fatalf("unexpected PCM params %+v", input)
+	}
+}
+
+func TestGetTTSRequestInput_GET_Download(t *testing.T) {
+	c, _ := newTestContext("GET", "/?text=hello&download=true", "")
+	if input, _ := getTTSRequestInput(c); !input.Download {
+		t.Fatalf("expected download to be set, got %+v", input)
+	}
+}
+
+func TestValidateOutputPCMFormat(t *testing.T) {
+	cases := []struct {
+		input TTSRequestInput
+		want  pcmFormat
+		err   string
+	}{
+		{TTSRequestInput{OutputFormat: "wav"}, pcmFormat{22050, 1, 16}, ""},
+		{TTSRequestInput{OutputFormat: "wav", SampleRate: 44100, Channels: 2, BitsPerSample: 32}, pcmFormat{44100, 2, 32}, ""},
+		{TTSRequestInput{OutputFormat: "mp3", SampleRate: 16000}, pcmFormat{16000, 1, 16}, ""},
+		{TTSRequestInput{OutputFormat: "wav", SampleRate: 12345}, pcmFormat{}, "invalid sampleRate"},
+		{TTSRequestInput{OutputFormat: "wav", Channels: 3}, pcmFormat{}, "invalid channels"},
+		{TTSRequestInput{OutputFormat: "wav", BitsPerSample: 12}, pcmFormat{}, "invalid bitsPerSample"},
+		{TTSRequestInput{OutputFormat: "flac", Channels: 2}, pcmFormat{}, "only supported with the wav outputFormat"},
+		{TTSRequestInput{OutputFormat: "ulaw", SampleRate: 16000}, pcmFormat{}, "always 8000 Hz"},
+	}
+	for _, tc := range cases {
+		format, err := validateOutputPCMFormat(tc.input, 22050)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("%+v: expected %q error, got %v", tc.input, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || format != tc.want {
+			t.Fatalf("%+v: expected %+v, got %+v, %v", tc.input, tc.want, format, err)
+		}
+	}
+}
+
+func TestPiperToAudioDownload_CompleteWAV(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+	voiceRegistry.set("test-download-voice", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	defer voiceRegistry.remove("test-download-voice")
+	voices := Voices{}
+	input := TTSRequestInput{Text: "hello", Voice: "test-download-voice", Speed: 1.0, OutputFormat: "wav", Download: true}
+
+	c, w := newTestContext("GET", "/api/tts", "")
+	cachedAudioStream(c, input, &voices, pool, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.Bytes()
+	if w.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Fatalf("expected Content-Length %d, got %q", len(body), w.Header().Get("Content-Length"))
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename="speech.wav"` {
+		t.Fatalf("unexpected Content-Disposition %q", disposition)
+	}
+	if size := binary.LittleEndian.Uint32(body[40:44]); size != uint32(len(body)-44) {
+		t.Fatalf("expected data size %d, got %d", len(body)-44, size)
+	}
+	if size := binary.LittleEndian.Uint32(body[4:8]); size != uint32(len(body)-8) {
+		t.Fatalf("expected RIFF size %d, got %d", len(body)-8, size)
+	}
+
+	c, w = newTestContext("GET", "/api/tts", "")
+	c.Request.Header.Set("Range", "bytes=44-")
+	cachedAudioStream(c, input, &voices, pool, nil)
+	if c.Writer.Status() != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", c.Writer.Status())
+	}
+	if !bytes.Equal(w.Body.Bytes(), body[44:]) {
+		t.Fatalf("expected the audio data, got %q", w.Body.String())
+	}
+}
+
+func TestPiperToAudioDownload_DoesNotServeStreamedAudio(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+	cache, err := newAudioCache(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	voiceRegistry.set("test-download-voice", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	defer voiceRegistry.remove("test-download-voice")
+	voices := Voices{}
+	input := TTSRequestInput{Text: "hello", Voice: "test-download-voice", Speed: 1.0, OutputFormat: "wav"}
+
+	c, w := newTestContext("GET", "/api/tts", "")
+	cachedAudioStream(c, input, &voices, pool, cache)
+	if w.Code != http.StatusOK || binary.LittleEndian.Uint32(w.Body.Bytes()[40:44]) != 0xFFFFFFFF {
+		t.Fatalf("expected a streamed WAV with placeholder sizes, got %d: %x", w.Code, w.Body.Bytes())
+	}
+
+	input.Download = true
+	c, w = newTestContext("GET", "/api/tts", "")
+	cachedAudioStream(c, input, &voices, pool, cache)
+	body := w.Body.Bytes()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, body)
+	}
+	if size := binary.LittleEndian.Uint32(body[40:44]); size != uint32(len(body)-44) {
+		t.Fatalf("expected data size %d, got %d", len(body)-44, size)
+	}
+	if size := binary.LittleEndian.Uint32(body[4:8]); size != uint32(len(body)-8) {
+		t.Fatalf("expected RIFF size %d, got %d", len(body)-8, size)
+	}
+}
+
+func TestPiperToAudioDownload_UsesCache(t *testing.T) {
+	cache, err := newAudioCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	voices := Voices{}
+	voiceRegistry.set("test-download-voice", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	defer voiceRegistry.remove("test-download-voice")
+	input := TTSRequestInput{Text: "hello", Voice: "test-download-voice", Speed: 1.0, OutputFormat: "ulaw-wav", Download: true}
+	writeCacheEntry(t, cache, testCacheKey(t, input, &voices), "cached audio")
+
+	c, w := newTestContext("GET", "/api/tts", "")
+	cachedAudioStream(c, input, &voices, nil, cache)
+	if w.Code != http.StatusOK || w.Body.String() != "cached audio" {
+		t.Fatalf("expected cached audio, got %d: %q", w.Code, w.Body.String())
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename="speech.wav"` {
+		t.Fatalf("unexpected Content-Disposition %q", disposition)
+	}
+}
+
+func TestPiperToAudioDownload_Error(t *testing.T) {
+	voices := Voices{}
+	c, w := newTestContext("GET", "/api/tts", "")
+	cachedAudioStream(c, TTSRequestInput{Text: "hello", Voice: "missing", OutputFormat: "wav", Download: true}, &voices, nil, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if w.Header().Get("Content-Disposition") != "" {
+		t.Fatal("expected errors not to be attachments")
+	}
+}
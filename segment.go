@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Sentence terminators per language family (the part of Voice.Language.Code
+// before the underscore), "" being the fallback.
+var sentenceTerminators = map[string]string{
+	"":   ".!?…",
+	"ar": ".!?؟",
+	"el": ".!;;",
+	"fa": ".!?؟",
+	"hi": ".!?।",
+	"hy": ".!?։",
+	"ja": ".!?。！？",
+	"ne": ".!?।",
+	"ur": ".!?؟۔",
+	"zh": ".!?。！？",
+}
+
+// Languages that don't put whitespace after a sentence, so any terminator
+// ends it.
+var unspacedLanguages = map[string]bool{
+	"ja": true,
+	"zh": true,
+}
+
+// Words that end with a period without ending the sentence, lower case and
+// without the final period.
+var sentenceAbbreviations = map[string][]string{
+	"de": {"bzw", "ca", "dr", "nr", "prof", "str", "usw", "vgl", "z.b"},
+	"en": {"dr", "e.g", "etc", "i.e", "jr", "mr", "mrs", "ms", "prof", "sr", "vs"},
+	"es": {"dr", "etc", "sr", "sra", "srta", "ud", "uds"},
+	"fr": {"dr", "etc", "m", "mlle", "mme", "p.ex"},
+	"it": {"dott", "ecc", "sig", "sig.ra"},
+	"nl": {"bijv", "dhr", "dr", "mevr", "nr"},
+}
+
+// Abbreviations that are also words ending sentences, so they only count as
+// abbreviations before a number, as in "No. 5", or when capitalized before a
+// capitalized name, as in "St. Louis".
+var (
+	numberAbbreviations = map[string][]string{
+		"en": {"no"},
+	}
+	nameAbbreviations = map[string][]string{
+		"en": {"st"},
+	}
+)
+
+const sentenceClosers = "\"'”’»)]}"
+
+func languageFamily(languageCode string) string {
+	family, _, _ := strings.Cut(languageCode, "_")
+	return strings.ToLower(family)
+}
+
+// isAbbreviation reports whether word, followed by a period, doesn't end the
+// sentence. next is the first character after the period and its spaces.
+func isAbbreviation(word string, next rune, family string) bool {
+	word = strings.TrimLeft(word, sentenceClosers+"([")
+	capitalized := strings.IndexFunc(word, unicode.IsUpper) == 0
+	word = strings.ToLower(word)
+	if len([]rune(word)) == 1 && unicode.IsLetter([]rune(word)[0]) {
+		// Initials such as "J. R. R. Tolkien"
+		return true
+	}
+	if slices.Contains(sentenceAbbreviations[family], word) {
+		return true
+	}
+	if slices.Contains(numberAbbreviations[family], word) {
+		return unicode.IsDigit(next)
+	}
+	if slices.Contains(nameAbbreviations[family], word) {
+		return capitalized && unicode.IsUpper(next)
+	}
+	return false
+}
+
+// splitSentences splits text into sentences using the punctuation rules of
+// the voice language. Line breaks always end a sentence.
+func splitSentences(text string, languageCode string) []string {
+	family := languageFamily(languageCode)
+	terminators, ok := sentenceTerminators[family]
+	if !ok {
+		terminators = sentenceTerminators[""]
+	}
+
+	var sentences []string
+	var current strings.Builder
+	flush := func() {
+		if sentence := strings.TrimSpace(current.String()); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		current.Reset()
+	}
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r == '\n' {
+			flush()
+			continue
+		}
+		current.WriteRune(r)
+		if !strings.ContainsRune(terminators, r) {
+			continue
+		}
+
+		for i+1 < len(runes) && (strings.ContainsRune(terminators, runes[i+1]) || strings.ContainsRune(sentenceClosers, runes[i+1])) {
+			i++
+			current.WriteRune(runes[i])
+		}
+		atEnd := i+1 >= len(runes)
+		if !unspacedLanguages[family] && !atEnd && !unicode.IsSpace(runes[i+1]) {
+			// "3.14", "example.com"
+			continue
+		}
+		if r == '.' {
+			fields := strings.Fields(current.String())
+			lastWord := strings.TrimRight(fields[len(fields)-1], terminators+sentenceClosers)
+			next := i + 1
+			for next < len(runes) && unicode.IsSpace(runes[next]) {
+				next++
+			}
+			var nextRune rune
+			if next < len(runes) {
+				nextRune = runes[next]
+			}
+			if isAbbreviation(lastWord, nextRune, family) {
+				continue
+			}
+		}
+		flush()
+	}
+	flush()
+
+	if len(sentences) == 0 {
+		return []string{text}
+	}
+	return sentences
+}
+
+// silenceBytes returns s16le mono silence of the given duration.
+func silenceBytes(sampleRate int, milliseconds int) []byte {
+	if milliseconds <= 0 {
+		return nil
+	}
+	return make([]byte, sampleRate*milliseconds/1000*2)
+}
+
+// sentenceStream synthesizes sentences one at a time on a single worker so
+// the first sentence can be played while the next ones are generated.
+type sentenceStream struct {
+	worker    *piperWorker
+	sentences []string
+	speaker   int
+	silence   []byte
+	current   io.Reader
+	started   bool
+	// onSentence, if set, is called each time a sentence has been fully read.
+	onSentence func()
+}
+
+func newSentenceStream(worker *piperWorker, sentences []string, silence []byte) *sentenceStream {
+	return &sentenceStream{worker: worker, sentences: sentences, silence: silence}
+}
+
+func (s *sentenceStream) Read(p []byte) (int, error) {
+	for {
+		if s.current != nil {
+			n, err := s.current.Read(p)
+			if err == io.EOF {
+				s.current = nil
+				if s.onSentence != nil {
+					s.onSentence()
+				}
+				if n > 0 {
+					return n, nil
+				}
+				continue
+			}
+			return n, err
+		}
+		if len(s.sentences) == 0 {
+			return 0, io.EOF
+		}
+
+		audio, err := s.worker.synthesize(s.sentences[0], s.speaker)
+		if err != nil {
+			return 0, err
+		}
+		s.sentences = s.sentences[1:]
+		if s.started && len(s.silence) > 0 {
+			s.current = io.MultiReader(bytes.NewReader(s.silence), audio)
+		} else {
+			s.current = audio
+		}
+		s.started = true
+	}
+}
+
+// ttsSegment is a part of a request synthesized with a single piper config,
+// or a pause when Pause is set.
+type ttsSegment struct {
+	Config   piperConfig
+	Text     string
+	Language string
+	Pause    int
+	// Sample rate of the segment voice, resampled to the one of the stream
+	// when it differs. 0 means the stream sample rate.
+	SampleRate int
+}
+
+// countSentences returns how many sentences a segmentStream over segments
+// synthesizes, for progress reporting.
+func countSentences(segments []ttsSegment) int {
+	count := 0
+	for _, segment := range segments {
+		if segment.Pause == 0 {
+			count += len(splitSentences(segment.Text, segment.Language))
+		}
+	}
+	return count
+}
+
+// segmentStream concatenates the PCM of each segment, borrowing a pooled
+// worker for each text segment only while it is being read. It must be
+// closed to hand back the current worker.
+type segmentStream struct {
+	ctx        context.Context
+	pool       *PiperPool
+	segments   []ttsSegment
+	sampleRate int
+	worker     *piperWorker
+	current    io.Reader
+	// onSentence, if set, is called each time a sentence has been fully read.
+	onSentence func()
+}
+
+func newSegmentStream(ctx context.Context, pool *PiperPool, segments []ttsSegment, sampleRate int) *segmentStream {
+	return &segmentStream{ctx: ctx, pool: pool, segments: segments, sampleRate: sampleRate}
+}
+
+func (s *segmentStream) Read(p []byte) (int, error) {
+	for {
+		if s.current != nil {
+			n, err := s.current.Read(p)
+			if err == io.EOF {
+				s.releaseWorker()
+				s.current = nil
+				if n > 0 {
+					return n, nil
+				}
+				continue
+			}
+			return n, err
+		}
+		if len(s.segments) == 0 {
+			return 0, io.EOF
+		}
+
+		segment := s.segments[0]
+		s.segments = s.segments[1:]
+		if segment.Pause > 0 {
+			s.current = bytes.NewReader(silenceBytes(s.sampleRate, segment.Pause))
+			continue
+		}
+		worker, err := s.pool.acquire(s.ctx, segment.Config)
+		if err != nil {
+			return 0, err
+		}
+		s.worker = worker
+		sampleRate := s.sampleRate
+		if segment.SampleRate > 0 {
+			sampleRate = segment.SampleRate
+		}
+		sentences := newSentenceStream(worker, splitSentences(segment.Text, segment.Language), silenceBytes(sampleRate, SENTENCE_PAUSE_MS))
+		sentences.speaker = segment.Config.Speaker
+		sentences.onSentence = s.onSentence
+		s.current = newResampler(sentences, sampleRate, s.sampleRate)
+	}
+}
+
+func (s *segmentStream) releaseWorker() {
+	if s.worker != nil {
+		s.pool.release(s.worker)
+		s.worker = nil
+	}
+}
+
+func (s *segmentStream) Close() error {
+	s.releaseWorker()
+	return nil
+}
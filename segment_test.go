@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitSentences(t *testing.T) {
+	tests := []struct {
+		text     string
+		language string
+		want     []string
+	}{
+		{"Hello world. How are you? Fine!", "en_US", []string{"Hello world.", "How are you?", "Fine!"}},
+		{"Dr. Smith paid 3.50 dollars.", "en_US", []string{"Dr. Smith paid 3.50 dollars."}},
+		{"He said \"stop.\" Then he left.", "en_GB", []string{"He said \"stop.\"", "Then he left."}},
+		{"Wait... what?! Really.", "en_US", []string{"Wait...", "what?!", "Really."}},
+		{"J. R. R. Tolkien wrote it.", "en_US", []string{"J. R. R. Tolkien wrote it."}},
+		{"The answer is no. Next one.", "en_US", []string{"The answer is no.", "Next one."}},
+		{"Track No. 5 is next.", "en_US", []string{"Track No. 5 is next."}},
+		{"We walked down the st. Then left.", "en_US", []string{"We walked down the st.", "Then left."}},
+		{"He lives in St. Louis.", "en_US", []string{"He lives in St. Louis."}},
+		{"First line\nSecond line", "en_US", []string{"First line", "Second line"}},
+		{"Das ist z.B. gut. Ja.", "de_DE", []string{"Das ist z.B. gut.", "Ja."}},
+		{"你好。今天天气很好！", "zh_CN", []string{"你好。", "今天天气很好！"}},
+		{"Τι κάνεις; Καλά.", "el_GR", []string{"Τι κάνεις;", "Καλά."}},
+		{"مرحبا؟ نعم.", "ar_JO", []string{"مرحبا؟", "نعم."}},
+		{"no terminator", "", []string{"no terminator"}},
+		{"   ", "en_US", []string{"   "}},
+	}
+	for _, tt := range tests {
+		if got := splitSentences(tt.text, tt.language); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitSentences(%q, %q) = %q, want %q", tt.text, tt.language, got, tt.want)
+		}
+	}
+}
+
+func TestSilenceBytes(t *testing.T) {
+	if n := len(silenceBytes(16000, 250)); n != 8000 {
+		t.Fatalf("expected 8000 bytes of silence, got %d", n)
+	}
+	if silenceBytes(16000, 0) != nil {
+		t.Fatal("expected no silence for a zero pause")
+	}
+}
+
+func TestSentenceStream_InsertsSilenceBetweenSentences(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+
+	w, err := pool.acquire(context.Background(), piperConfig{Voice: "en_US-amy-low", LengthScale: 1.0})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer pool.release(w)
+
+	data, err := io.ReadAll(newSentenceStream(w, []string{"One.", "Two."}, []byte{0, 0}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []byte(`audio:{"text":"One."}` + "\x00\x00" + `audio:{"text":"Two."}`)
+	if !bytes.Equal(data, want) {
+		t.Fatalf("expected %q, got %q", want, data)
+	}
+	if !w.reusable() {
+		t.Fatal("expected worker to be reusable after reading all sentences")
+	}
+}
+
+func TestSegmentStream_ResamplesSegments(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+
+	segments := []ttsSegment{
+		{Config: piperConfig{Voice: "test-main"}, Text: "hey", Language: "en_US"},
+		{Config: piperConfig{Voice: "test-low"}, Text: "hey", Language: "en_US", SampleRate: 8000},
+	}
+	audio := newSegmentStream(context.Background(), pool, segments, 16000)
+	defer audio.Close()
+	data, err := io.ReadAll(audio)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The fake piper outputs `audio:{"text":"hey"}`, 10 samples, doubled by
+	// resampling the second segment from 8 kHz to 16 kHz
+	if len(data) != 20+2*20 {
+		t.Fatalf("expected %d bytes, got %d", 20+2*20, len(data))
+	}
+}
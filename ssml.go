@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SSMLError is returned for invalid SSML input, Position being the byte
+// offset in the input where the problem was found.
+type SSMLError struct {
+	Message  string `json:"error"`
+	Position int64  `json:"position"`
+	// Err is the error getting a <voice> ready, such as errVoiceNotInstalled
+	Err error `json:"-"`
+}
+
+func (e *SSMLError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Position)
+}
+
+// ssmlSegment is either text spoken with a voice at a rate relative to the
+// request speed, or a pause in milliseconds.
+type ssmlSegment struct {
+	Text     string
+	Voice    string
+	Rate     float64
+	Pause    int
+	Position int64
+}
+
+type ssmlState struct {
+	element     string
+	voice       string
+	rate        float64
+	interpretAs string
+	position    int64
+}
+
+var ssmlBreakStrengths = map[string]int{
+	"none":     0,
+	"x-weak":   100,
+	"weak":     250,
+	"medium":   500,
+	"strong":   750,
+	"x-strong": 1000,
+}
+
+var ssmlRates = map[string]float64{
+	"x-slow":  0.5,
+	"slow":    0.75,
+	"medium":  1.0,
+	"default": 1.0,
+	"fast":    1.25,
+	"x-fast":  1.75,
+}
+
+const ssmlMaxBreakMs = 10000
+
+func ssmlAttr(element xml.StartElement, name string) (string, bool) {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// parseSSMLRate accepts rate keywords, percentages ("120%", "+20%", "-10%")
+// and multipliers ("1.5").
+func parseSSMLRate(value string) (float64, error) {
+	if rate, ok := ssmlRates[value]; ok {
+		return rate, nil
+	}
+	if strings.HasSuffix(value, "%") {
+		number := strings.TrimSuffix(value, "%")
+		percent, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid prosody rate %q", value)
+		}
+		rate := percent / 100
+		if strings.HasPrefix(number, "+") || strings.HasPrefix(number, "-") {
+			rate = 1 + percent/100
+		}
+		if rate <= 0 {
+			return 0, fmt.Errorf("invalid prosody rate %q", value)
+		}
+		return rate, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid prosody rate %q", value)
+	}
+	return rate, nil
+}
+
+func parseSSMLBreak(element xml.StartElement) (int, error) {
+	if value, ok := ssmlAttr(element, "time"); ok {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return 0, fmt.Errorf("invalid break time %q", value)
+		}
+		if duration > ssmlMaxBreakMs*time.Millisecond {
+			return 0, fmt.Errorf("break time %q exceeds %dms", value, ssmlMaxBreakMs)
+		}
+		return int(duration.Milliseconds()), nil
+	}
+	if value, ok := ssmlAttr(element, "strength"); ok {
+		pause, ok := ssmlBreakStrengths[value]
+		if !ok {
+			return 0, fmt.Errorf("invalid break strength %q", value)
+		}
+		return pause, nil
+	}
+	return ssmlBreakStrengths["medium"], nil
+}
+
+// renderSayAs spells out text piper would otherwise read as a word or number.
+func renderSayAs(text string, interpretAs string) string {
+	switch interpretAs {
+	case "characters", "spell-out", "verbatim":
+		var letters []string
+		for _, r := range text {
+			if !unicode.IsSpace(r) {
+				letters = append(letters, string(r))
+			}
+		}
+		return strings.Join(letters, " ")
+	case "digits":
+		var digits []string
+		for _, r := range text {
+			if unicode.IsDigit(r) {
+				digits = append(digits, string(r))
+			}
+		}
+		return strings.Join(digits, " ")
+	}
+	return text
+}
+
+// parseSSML parses the supported SSML subset: <speak>, <break>, <prosody
+// rate>, <voice name>, <say-as interpret-as> and <sub alias>.
+func parseSSML(input string, voice string) ([]ssmlSegment, error) {
+	decoder := xml.NewDecoder(strings.NewReader(input))
+	stack := []ssmlState{{voice: voice, rate: 1.0}}
+	var segments []ssmlSegment
+	subDepth := 0
+	seenSpeak := false
+
+	appendText := func(text string, position int64) {
+		state := stack[len(stack)-1]
+		if state.position > 0 {
+			// Report voice errors at the <voice> element
+			position = state.position
+		}
+		if last := len(segments) - 1; last >= 0 && segments[last].Pause == 0 && segments[last].Voice == state.voice && segments[last].Rate == state.rate {
+			segments[last].Text += text
+			return
+		}
+		segments = append(segments, ssmlSegment{Text: text, Voice: state.voice, Rate: state.rate, Position: position})
+	}
+
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &SSMLError{Message: err.Error(), Position: decoder.InputOffset()}
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			if len(stack) == 1 && (name != "speak" || seenSpeak) {
+				return nil, &SSMLError{Message: "root element must be a single <speak>", Position: offset}
+			}
+			state := stack[len(stack)-1]
+			state.element = name
+			switch name {
+			case "speak":
+				seenSpeak = true
+			case "break":
+				pause, err := parseSSMLBreak(t)
+				if err != nil {
+					return nil, &SSMLError{Message: err.Error(), Position: offset}
+				}
+				if pause > 0 {
+					segments = append(segments, ssmlSegment{Pause: pause, Position: offset})
+				}
+			case "prosody":
+				if value, ok := ssmlAttr(t, "rate"); ok {
+					rate, err := parseSSMLRate(value)
+					if err != nil {
+						return nil, &SSMLError{Message: err.Error(), Position: offset}
+					}
+					state.rate *= rate
+				}
+			case "voice":
+				value, ok := ssmlAttr(t, "name")
+				if !ok || value == "" {
+					return nil, &SSMLError{Message: "<voice> requires a name attribute", Position: offset}
+				}
+				state.voice = value
+				state.position = offset
+			case "say-as":
+				value, ok := ssmlAttr(t, "interpret-as")
+				if !ok {
+					return nil, &SSMLError{Message: "<say-as> requires an interpret-as attribute", Position: offset}
+				}
+				state.interpretAs = value
+			case "sub":
+				value, ok := ssmlAttr(t, "alias")
+				if !ok {
+					return nil, &SSMLError{Message: "<sub> requires an alias attribute", Position: offset}
+				}
+				if subDepth == 0 {
+					appendText(value, offset)
+				}
+				subDepth++
+			default:
+				return nil, &SSMLError{Message: fmt.Sprintf("unsupported element <%s>", name), Position: offset}
+			}
+			stack = append(stack, state)
+		case xml.EndElement:
+			if stack[len(stack)-1].element == "sub" {
+				subDepth--
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			text := string(t)
+			if len(stack) == 1 {
+				if strings.TrimSpace(text) != "" {
+					return nil, &SSMLError{Message: "text outside of <speak>", Position: offset}
+				}
+				continue
+			}
+			if subDepth > 0 {
+				continue
+			}
+			appendText(renderSayAs(text, stack[len(stack)-1].interpretAs), offset)
+		}
+	}
+	if !seenSpeak {
+		return nil, &SSMLError{Message: "missing <speak> root element", Position: 0}
+	}
+
+	result := segments[:0]
+	for _, segment := range segments {
+		if segment.Pause == 0 {
+			segment.Text = strings.Join(strings.Fields(segment.Text), " ")
+			if segment.Text == "" {
+				continue
+			}
+		}
+		result = append(result, segment)
+	}
+	return result, nil
+}
+
+// ssmlToSegments parses SSML and resolves the voices it switches to. Voices
+// with another sample rate than the request voice are resampled to it, since
+// their audio ends up in the same stream. Voices other than the request one
+// use their first speaker.
+func ssmlToSegments(input string, voices *Voices, config piperConfig, params inferenceParameters, speed float64) ([]ttsSegment, error) {
+	parsed, err := parseSSML(input, config.Voice)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]ttsSegment, 0, len(parsed))
+	for _, s := range parsed {
+		if s.Pause > 0 {
+			segments = append(segments, ttsSegment{Pause: s.Pause})
+			continue
+		}
+		voiceName, err := resolveVoiceName(voices, s.Voice)
+		if err != nil {
+			return nil, &SSMLError{Message: err.Error(), Position: s.Position}
+		}
+		details, err := getVoiceDetails(voices, voiceName)
+		if err == errVoiceNotInstalled || err == errVoicesQuotaExceeded {
+			return nil, &SSMLError{Message: fmt.Sprintf("voice %s: %v", s.Voice, err), Position: s.Position, Err: err}
+		} else if err != nil {
+			return nil, &SSMLError{Message: fmt.Sprintf("voice not found: %s", s.Voice), Position: s.Position}
+		}
+		segmentConfig := config
+		segmentConfig.Voice = voiceName
+		if voiceName != config.Voice {
+			segmentConfig.Speaker = 0
+		}
+		segmentConfig.LengthScale = speedToLengthScale(speed * s.Rate)
+		segments = append(segments, ttsSegment{
+			Config:     applyInferenceDefaults(segmentConfig, params, details),
+			Text:       s.Text,
+			Language:   (*voices)[voiceName].Language.Code,
+			SampleRate: details.Audio.SampleRate,
+		})
+	}
+	return segments, nil
+}
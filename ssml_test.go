@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestParseSSML_Segments(t *testing.T) {
+	input := `<speak>Hello <break time="500ms"/> <prosody rate="slow">slow <voice name="other">there</voice></prosody> <sub alias="World Wide Web">WWW</sub> <say-as interpret-as="characters">abc</say-as></speak>`
+	segments, err := parseSSML(input, "main")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ssmlSegment{
+		{Text: "Hello", Voice: "main", Rate: 1.0},
+		{Pause: 500},
+		{Text: "slow", Voice: "main", Rate: 0.75},
+		{Text: "there", Voice: "other", Rate: 0.75},
+		{Text: "World Wide Web a b c", Voice: "main", Rate: 1.0},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("expected %d segments, got %+v", len(want), segments)
+	}
+	for i, segment := range segments {
+		if segment.Text != want[i].Text || segment.Voice != want[i].Voice || segment.Rate != want[i].Rate || segment.Pause != want[i].Pause {
+			t.Errorf("segment %d: expected %+v, got %+v", i, want[i], segment)
+		}
+	}
+}
+
+func TestParseSSMLRate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"fast", 1.25},
+		{"150%", 1.5},
+		{"+20%", 1.2},
+		{"-50%", 0.5},
+		{"0.8", 0.8},
+	}
+	for _, tt := range tests {
+		if got, err := parseSSMLRate(tt.value); err != nil || got != tt.want {
+			t.Errorf("parseSSMLRate(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+	for _, value := range []string{"quick", "-100%", "0"} {
+		if _, err := parseSSMLRate(value); err == nil {
+			t.Errorf("expected error for rate %q", value)
+		}
+	}
+}
+
+func TestRenderSayAs_Digits(t *testing.T) {
+	if got := renderSayAs("1-2 3", "digits"); got != "1 2 3" {
+		t.Fatalf("expected '1 2 3', got %q", got)
+	}
+}
+
+func TestParseSSML_Errors(t *testing.T) {
+	tests := []struct {
+		input    string
+		position int64
+	}{
+		{`<speak>Hello <emphasis>there</emphasis></speak>`, 13},
+		{`<speak>Hello <break time="forever"/></speak>`, 13},
+		{`<speak>Hello <break time="20s"/></speak>`, 13},
+		{`<speak><voice>Hi</voice></speak>`, 7},
+		{`Hello`, 0},
+		{`<p>Hello</p>`, 0},
+		{`<speak>Hello`, 12},
+	}
+	for _, tt := range tests {
+		_, err := parseSSML(tt.input, "main")
+		ssmlErr, ok := err.(*SSMLError)
+		if !ok {
+			t.Errorf("parseSSML(%q): expected *SSMLError, got %v", tt.input, err)
+			continue
+		}
+		if ssmlErr.Position != tt.position {
+			t.Errorf("parseSSML(%q): expected position %d, got %d (%s)", tt.input, tt.position, ssmlErr.Position, ssmlErr.Message)
+		}
+	}
+}
+
+func TestSSMLToSegments_OtherSampleRate(t *testing.T) {
+	voices := Voices{}
+	voiceRegistry.set("test-ssml-main", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 22050}})
+	voiceRegistry.set("test-ssml-low", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	defer voiceRegistry.remove("test-ssml-main")
+	defer voiceRegistry.remove("test-ssml-low")
+
+	segments, err := ssmlToSegments(`<speak>Hi <voice name="test-ssml-low">there</voice></speak>`, &voices, piperConfig{Voice: "test-ssml-main"}, inferenceParameters{}, 1.0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(segments) != 2 || segments[0].SampleRate != 22050 || segments[1].SampleRate != 16000 {
+		t.Fatalf("expected the sample rate of each voice, got %+v", segments)
+	}
+}
+
+func TestPiperToAudioStream_SSMLVoiceNotInstalled(t *testing.T) {
+	previous := VOICE_DOWNLOAD_ON_DEMAND
+	VOICE_DOWNLOAD_ON_DEMAND = false
+	defer func() { VOICE_DOWNLOAD_ON_DEMAND = previous }()
+	voices := Voices{"test-ssml-missing": {Key: "test-ssml-missing"}}
+	voiceRegistry.set("test-ssml-main", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 22050}})
+	defer voiceRegistry.remove("test-ssml-main")
+
+	c, w := newTestContext("GET", "/", "")
+	piperToAudioStream(c, TTSRequestInput{Text: `<speak>Hi <voice name="test-ssml-missing">there</voice></speak>`, Voice: "test-ssml-main", OutputFormat: "wav", SSML: true}, &voices, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d: %s", w.Code, w.Body.String())
+	}
+	var result SSMLError
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Position != 10 {
+		t.Fatalf("unexpected error body %q", w.Body.String())
+	}
+}
+
+func TestSSMLToSegments_SpeedAndSpeaker(t *testing.T) {
+	voices := Voices{}
+	voiceRegistry.set("test-ssml-main", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 22050}})
+	defer voiceRegistry.remove("test-ssml-main")
+
+	segments, err := ssmlToSegments(`<speak><prosody rate="200%">fast</prosody><break strength="weak"/></speak>`, &voices, piperConfig{Voice: "test-ssml-main", Speaker: 2}, inferenceParameters{NoiseScale: floatPtr(0.3)}, 1.0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("expected 2 segments, got %+v", segments)
+	}
+	if segments[0].Config.LengthScale != 0.5 || segments[0].Config.Speaker != 2 || segments[0].Config.NoiseScale != 0.3 {
+		t.Fatalf("unexpected config %+v", segments[0].Config)
+	}
+	if segments[1].Pause != 250 {
+		t.Fatalf("expected 250ms pause, got %d", segments[1].Pause)
+	}
+}
+
+func TestPiperToAudioStream_InvalidSSML(t *testing.T) {
+	voices := Voices{}
+	voiceRegistry.set("test-ssml-main", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 22050}})
+	defer voiceRegistry.remove("test-ssml-main")
+
+	c, w := newTestContext("GET", "/", "")
+	piperToAudioStream(c, TTSRequestInput{Text: "<speak>Hello <foo/></speak>", Voice: "test-ssml-main", OutputFormat: "wav", SSML: true}, &voices, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var result SSMLError
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("response is not valid JSON: %v", err)
+	}
+	if result.Position != 13 || result.Message == "" {
+		t.Fatalf("unexpected error body %+v", result)
+	}
+}
@@ -7,9 +7,10 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 )
 
 // These describe the voices.json file
@@ -23,6 +24,8 @@ type Voice struct {
 	SpeakerIDMap map[string]interface{} `json:"speaker_id_map"`
 	Files        map[string]File        `json:"files"`
 	Aliases      []string               `json:"aliases"`
+	// Custom voices were uploaded rather than downloaded from the catalog
+	Custom bool `json:"custom,omitempty"`
 }
 
 type Language struct {
@@ -44,26 +47,70 @@ type Voices map[string]Voice
 // This describes the individual voice json files
 
 type VoiceDetails struct {
-	Audio        VoiceDetailsAudio `json:"audio"`
-	SpeakerIdMap map[string]int    `json:"speaker_id_map"`
+	Audio        VoiceDetailsAudio     `json:"audio"`
+	Inference    VoiceDetailsInference `json:"inference"`
+	NumSpeakers  int                   `json:"num_speakers"`
+	SpeakerIdMap map[string]int        `json:"speaker_id_map"`
 }
 
 type VoiceDetailsAudio struct {
 	SampleRate int `json:"sample_rate"`
 }
 
-var DOWNLOADED_VOICES = make(map[string]VoiceDetails)
+// VoiceDetailsInference holds the synthesis defaults of a voice. Piper has no
+// per voice sentence silence, it is only listed here so clients see its default.
+type VoiceDetailsInference struct {
+	NoiseScale      float64 `json:"noise_scale"`
+	LengthScale     float64 `json:"length_scale"`
+	NoiseW          float64 `json:"noise_w"`
+	SentenceSilence float64 `json:"sentence_silence"`
+}
+
+// Piper's own defaults, used when a voice config doesn't specify them.
+var defaultVoiceInference = VoiceDetailsInference{
+	NoiseScale:      0.667,
+	LengthScale:     1.0,
+	NoiseW:          0.8,
+	SentenceSilence: 0.2,
+}
+
+// VoiceWithDefaults is a catalog entry along with the synthesis defaults of
+// the voice when it is downloaded.
+type VoiceWithDefaults struct {
+	Voice
+	Inference *VoiceDetailsInference `json:"inference,omitempty"`
+}
 
 func loadVoicesDetails() {
 	if _, err := os.Stat(VOICES_PATH); os.IsNotExist(err) {
 		os.Mkdir(VOICES_PATH, 0755)
 	}
 
-	files, err := os.ReadDir(VOICES_PATH)
+	voiceNames, err := scanVoicesPath()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	for voiceName := range voiceNames {
+		voice, err := parseVoiceDetails(fmt.Sprintf("%s/%s.onnx.json", VOICES_PATH, voiceName))
+		if err != nil {
+			log.Println("Failed to get voice details: ", err)
+			continue
+		}
+
+		voiceRegistry.set(voiceName, voice)
+	}
+}
+
+// scanVoicesPath returns the voices of VOICES_PATH that have both their model
+// and their config.
+func scanVoicesPath() (map[string]bool, error) {
+	files, err := os.ReadDir(VOICES_PATH)
+	if err != nil {
+		return nil, err
+	}
+
+	voiceNames := make(map[string]bool)
 	for _, file := range files {
 		if file.IsDir() {
 			continue
@@ -81,35 +128,36 @@ func loadVoicesDetails() {
 			continue
 		}
 
-		voiceName = voiceName[:len(voiceName)-5]
-
-		voice, err := parseVoiceDetails(fmt.Sprintf("%s/%s", VOICES_PATH, file.Name()))
-		if err != nil {
-			log.Println("Failed to get voice details: ", err)
-			continue
-		}
-
-		DOWNLOADED_VOICES[voiceName] = voice
+		voiceNames[voiceName[:len(voiceName)-5]] = true
 	}
+	return voiceNames, nil
 }
 
 func ensureVoices(voiceNames []string, voices *Voices) {
 	log.Println("Ensuring preloaded voices are downloaded")
 	for _, voiceName := range voiceNames {
-		getVoiceDetails(voices, voiceName)
+		if err := voiceRegistry.download(voices, voiceName); err != nil {
+			log.Printf("Failed to download preloaded voice %s: %v", voiceName, err)
+		}
 	}
 	log.Println("All Preloaded are downloaded")
 }
 
+// getVoiceDetails returns the details of a voice to synthesize with,
+// downloading it first unless VOICE_DOWNLOAD_ON_DEMAND is disabled.
 func getVoiceDetails(voices *Voices, voiceName string) (VoiceDetails, error) {
-	voice, ok := DOWNLOADED_VOICES[voiceName]
+	voice, ok := voiceRegistry.get(voiceName)
 	if !ok {
-		err := downloadVoiceFiles(voices, voiceName)
+		if !VOICE_DOWNLOAD_ON_DEMAND {
+			return VoiceDetails{}, errVoiceNotInstalled
+		}
+		err := voiceRegistry.download(voices, voiceName)
 		if err != nil {
 			return VoiceDetails{}, err
 		}
-		voice = DOWNLOADED_VOICES[voiceName]
+		voice, _ = voiceRegistry.get(voiceName)
 	}
+	voiceRegistry.touch(voiceName)
 	return voice, nil
 }
 
@@ -126,6 +174,18 @@ func parseVoiceDetails(filePath string) (VoiceDetails, error) {
 	if err != nil {
 		return voice, err
 	}
+	if voice.Inference.NoiseScale == 0 {
+		voice.Inference.NoiseScale = defaultVoiceInference.NoiseScale
+	}
+	if voice.Inference.LengthScale == 0 {
+		voice.Inference.LengthScale = defaultVoiceInference.LengthScale
+	}
+	if voice.Inference.NoiseW == 0 {
+		voice.Inference.NoiseW = defaultVoiceInference.NoiseW
+	}
+	if voice.Inference.SentenceSilence == 0 {
+		voice.Inference.SentenceSilence = defaultVoiceInference.SentenceSilence
+	}
 	return voice, nil
 }
 
@@ -147,57 +207,129 @@ func getAvailableVoices(voicesPath string) Voices {
 
 }
 
-func downloadVoiceFiles(voices *Voices, voiceName string) error {
-	if _, ok := DOWNLOADED_VOICES[voiceName]; ok {
-		return nil
-	}
-
+// downloadVoiceFiles downloads the files of a voice that aren't in
+// VOICES_PATH yet and returns its details, reporting the state of each file
+// to onProgress. Use voiceRegistry.download instead so that concurrent
+// downloads of a voice are merged.
+func downloadVoiceFiles(voices *Voices, voiceName string, onProgress func(fileName string, progress VoiceFileProgress)) (VoiceDetails, error) {
 	voice, ok := (*voices)[voiceName]
 	if !ok {
-		return fmt.Errorf("Voice not found: %s", voiceName)
+		return VoiceDetails{}, fmt.Errorf("Voice not found: %s", voiceName)
 	}
 
+	var fileNames []string
 	for fileName, fileInfo := range voice.Files {
-		baseFilename := filepath.Base(fileName)
-		if baseFilename == "MODEL_CARD" {
+		if filepath.Base(fileName) == "MODEL_CARD" {
 			continue
 		}
-		filePath := fmt.Sprintf("%s/%s", VOICES_PATH, baseFilename)
+		fileNames = append(fileNames, fileName)
+		onProgress(fileName, VoiceFileProgress{SizeBytes: fileInfo.SizeBytes, Status: "pending"})
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		fileInfo := voice.Files[fileName]
+		filePath := voiceFilePath(fileName)
 		if _, err := os.Stat(filePath); err == nil {
 			log.Println("File already exists, skipping download", filePath)
+			onProgress(fileName, VoiceFileProgress{Bytes: fileInfo.SizeBytes, SizeBytes: fileInfo.SizeBytes, Status: "existing"})
 			continue
 		}
+		progress := &progressWriter{onWrite: func(written int64) {
+			onProgress(fileName, VoiceFileProgress{Bytes: written, SizeBytes: fileInfo.SizeBytes, Status: "downloading"})
+		}}
+		if err := downloadVoiceFile(fileName, fileInfo, progress); err != nil {
+			onProgress(fileName, VoiceFileProgress{Bytes: progress.written, SizeBytes: fileInfo.SizeBytes, Status: "failed"})
+			return VoiceDetails{}, err
+		}
+		onProgress(fileName, VoiceFileProgress{Bytes: progress.written, SizeBytes: fileInfo.SizeBytes, Status: "verified"})
+	}
+	return parseVoiceDetails(fmt.Sprintf("%s/%s.onnx.json", VOICES_PATH, voiceName))
+}
 
-		url := fmt.Sprintf("%s/%s", VOICES_REPO_BASE_URL, fileName)
-		log.Printf("Downloading '%s' to '%s'\n", url, filePath)
+// resolveSpeaker returns the ID of a speaker of a voice, given either its name
+// in the speaker map or its numeric ID. An empty speaker is the first one.
+func resolveSpeaker(voice VoiceDetails, speaker string) (int, error) {
+	if speaker == "" {
+		return 0, nil
+	}
+	if id, ok := voice.SpeakerIdMap[speaker]; ok {
+		return id, nil
+	}
+	numSpeakers := max(voice.NumSpeakers, len(voice.SpeakerIdMap), 1)
+	if id, err := strconv.Atoi(speaker); err == nil && id >= 0 && id < numSpeakers {
+		return id, nil
+	}
+	return 0, fmt.Errorf("invalid speaker %q, must be a speaker name of the voice or an ID between 0 and %d", speaker, numSpeakers-1)
+}
 
-		out, err := os.Create(filePath)
-		if err != nil {
-			return err
-		}
-		defer out.Close()
+// voiceFilePath returns where a file of the voices.json catalog is stored,
+// the catalog paths being flattened into VOICES_PATH.
+func voiceFilePath(fileName string) string {
+	return fmt.Sprintf("%s/%s", VOICES_PATH, filepath.Base(fileName))
+}
 
-		resp, err := http.Get(url)
-		if err != nil {
-			log.Println("Failed to download", url, ":", err)
-			return err
+func fileMD5(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VoiceFileStatus compares a voice file on disk with the catalog. Checksum is
+// "ok", "mismatch" or "missing".
+type VoiceFileStatus struct {
+	SizeBytes         int64  `json:"size_bytes"`
+	ExpectedSizeBytes int64  `json:"expected_size_bytes"`
+	Checksum          string `json:"checksum"`
+}
+
+type VoiceStatus struct {
+	Key       string `json:"key"`
+	Installed bool   `json:"installed"`
+	// Whether requests for the voice download it when it isn't installed
+	DownloadOnDemand bool                       `json:"downloadOnDemand"`
+	Files            map[string]VoiceFileStatus `json:"files"`
+}
+
+func getVoiceStatus(voiceName string, voice Voice) VoiceStatus {
+	_, installed := voiceRegistry.get(voiceName)
+	status := VoiceStatus{Key: voiceName, Installed: installed, DownloadOnDemand: VOICE_DOWNLOAD_ON_DEMAND, Files: make(map[string]VoiceFileStatus)}
+	for fileName, fileInfo := range voice.Files {
+		if filepath.Base(fileName) == "MODEL_CARD" {
+			continue
 		}
-		defer resp.Body.Close()
+		fileStatus := VoiceFileStatus{ExpectedSizeBytes: fileInfo.SizeBytes, Checksum: "missing"}
+		if info, err := os.Stat(voiceFilePath(fileName)); err == nil {
+			fileStatus.SizeBytes = info.Size()
+			fileStatus.Checksum = "mismatch"
+			if sum, err := fileMD5(voiceFilePath(fileName)); err == nil && sum == fileInfo.MD5Digest {
+				fileStatus.Checksum = "ok"
+			}
+		}
+		status.Files[fileName] = fileStatus
+	}
+	return status
+}
 
-		h := md5.New()
-		if _, err = io.Copy(out, io.TeeReader(resp.Body, h)); err != nil {
+// deleteVoiceFiles removes the files of a voice from VOICES_PATH.
+func deleteVoiceFiles(voice Voice) error {
+	for fileName := range voice.Files {
+		if filepath.Base(fileName) == "MODEL_CARD" {
+			continue
+		}
+		if err := os.Remove(voiceFilePath(fileName)); err != nil && !os.IsNotExist(err) {
 			return err
 		}
-		if got := hex.EncodeToString(h.Sum(nil)); got != fileInfo.MD5Digest {
-			os.Remove(filePath)
-			return fmt.Errorf("MD5 mismatch for %s: got %s, want %s", fileName, got, fileInfo.MD5Digest)
+		if err := os.Remove(voiceFilePath(fileName) + partialDownloadSuffix); err != nil && !os.IsNotExist(err) {
+			return err
 		}
-		log.Printf("Downloaded '%s' to '%s'\n", url, filePath)
-	}
-	voiceDetails, err := parseVoiceDetails(fmt.Sprintf("%s/%s.onnx.json", VOICES_PATH, voiceName))
-	if err != nil {
-		return err
 	}
-	DOWNLOADED_VOICES[voiceName] = voiceDetails
 	return nil
 }
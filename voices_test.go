@@ -47,8 +47,8 @@ func TestParseVoiceDetails_FileNotFound(t *testing.T) {
 func TestGetVoiceDetails_Cached(t *testing.T) {
 	voices := Voices{}
 	const name = "test-cached-voice"
-	DOWNLOADED_VOICES[name] = VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 22050}}
-	defer delete(DOWNLOADED_VOICES, name)
+	voiceRegistry.set(name, VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 22050}})
+	defer voiceRegistry.remove(name)
 
 	v, err := getVoiceDetails(&voices, name)
 	if err != nil {
@@ -67,20 +67,119 @@ func TestGetVoiceDetails_NotFound(t *testing.T) {
 	}
 }
 
-func TestDownloadVoiceFiles_AlreadyDownloaded(t *testing.T) {
+func TestDownloadVoiceFiles_NotInList(t *testing.T) {
 	voices := Voices{}
-	const name = "test-downloaded-voice"
-	DOWNLOADED_VOICES[name] = VoiceDetails{}
-	defer delete(DOWNLOADED_VOICES, name)
+	if _, err := downloadVoiceFiles(&voices, "missing-voice", func(string, VoiceFileProgress) {}); err == nil {
+		t.Fatal("expected error for voice not in list")
+	}
+}
 
-	if err := downloadVoiceFiles(&voices, name); err != nil {
-		t.Fatalf("expected nil for already-downloaded voice, got %v", err)
+func TestParseVoiceDetails_InferenceDefaults(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "voice.json")
+	content := `{"audio":{"sample_rate":22050},"inference":{"noise_scale":0.333}}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, err := parseVoiceDetails(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v.Inference.NoiseScale != 0.333 {
+		t.Fatalf("expected noise scale from config, got %v", v.Inference.NoiseScale)
+	}
+	if v.Inference.NoiseW != defaultVoiceInference.NoiseW || v.Inference.SentenceSilence != defaultVoiceInference.SentenceSilence {
+		t.Fatalf("expected piper defaults for missing values, got %+v", v.Inference)
 	}
 }
 
-func TestDownloadVoiceFiles_NotInList(t *testing.T) {
-	voices := Voices{}
-	if err := downloadVoiceFiles(&voices, "missing-voice"); err == nil {
-		t.Fatal("expected error for voice not in list")
+// useTempVoicesPath points VOICES_PATH to an empty directory for the test.
+func useTempVoicesPath(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	previous := VOICES_PATH
+	VOICES_PATH = dir
+	t.Cleanup(func() { VOICES_PATH = previous })
+	return dir
+}
+
+func TestGetVoiceStatus_ChecksFiles(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	os.WriteFile(filepath.Join(dir, "good.onnx"), []byte("model"), 0644)
+	os.WriteFile(filepath.Join(dir, "bad.onnx.json"), []byte("config"), 0644)
+	voice := Voice{Files: map[string]File{
+		"en/good.onnx":     {SizeBytes: 5, MD5Digest: "20f35e630daf44dbfa4c3f68f5399d8c"},
+		"en/bad.onnx.json": {SizeBytes: 6, MD5Digest: "00000000000000000000000000000000"},
+		"en/missing.onnx":  {SizeBytes: 7},
+		"en/MODEL_CARD":    {SizeBytes: 8},
+	}}
+
+	status := getVoiceStatus("test-status-voice", voice)
+	if status.Installed {
+		t.Fatal("expected voice not to be installed")
+	}
+	if status.DownloadOnDemand != VOICE_DOWNLOAD_ON_DEMAND {
+		t.Fatalf("expected downloadOnDemand to follow VOICE_DOWNLOAD_ON_DEMAND, got %v", status.DownloadOnDemand)
+	}
+	if len(status.Files) != 3 {
+		t.Fatalf("expected MODEL_CARD to be skipped, got %v", status.Files)
+	}
+	if got := status.Files["en/good.onnx"]; got.Checksum != "ok" || got.SizeBytes != 5 {
+		t.Fatalf("unexpected status for good file %+v", got)
+	}
+	if got := status.Files["en/bad.onnx.json"]; got.Checksum != "mismatch" {
+		t.Fatalf("unexpected status for bad file %+v", got)
+	}
+	if got := status.Files["en/missing.onnx"]; got.Checksum != "missing" || got.ExpectedSizeBytes != 7 {
+		t.Fatalf("unexpected status for missing file %+v", got)
+	}
+}
+
+func TestDeleteVoiceFiles_RemovesFiles(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	os.WriteFile(filepath.Join(dir, "v.onnx"), []byte("model"), 0644)
+	os.WriteFile(filepath.Join(dir, "v.onnx.json"), []byte("config"), 0644)
+	voice := Voice{Files: map[string]File{"en/v.onnx": {}, "en/v.onnx.json": {}, "en/MODEL_CARD": {}}}
+
+	if err := deleteVoiceFiles(voice); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected voice files to be deleted, got %v", files)
+	}
+}
+
+func TestLoadVoicesDetails_IgnoresPartialFiles(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	os.WriteFile(filepath.Join(dir, "test-partial-voice.onnx"), []byte("model"), 0644)
+	os.WriteFile(filepath.Join(dir, "test-partial-voice.onnx.json"+partialDownloadSuffix), []byte(`{"audio"`), 0644)
+	os.WriteFile(filepath.Join(dir, "test-load-voice.onnx"), []byte("model"), 0644)
+	os.WriteFile(filepath.Join(dir, "test-load-voice.onnx.json"), []byte(`{"audio":{"sample_rate":16000}}`), 0644)
+	defer voiceRegistry.remove("test-load-voice")
+
+	loadVoicesDetails()
+	if _, ok := voiceRegistry.get("test-load-voice"); !ok {
+		t.Fatal("expected voice to be loaded")
+	}
+	if _, ok := voiceRegistry.get("test-partial-voice"); ok {
+		t.Fatal("expected partially downloaded voice not to be loaded")
+	}
+}
+
+func TestResolveSpeaker(t *testing.T) {
+	voice := VoiceDetails{NumSpeakers: 3, SpeakerIdMap: map[string]int{"alice": 0, "bob": 2}}
+	cases := map[string]int{"": 0, "bob": 2, "1": 1, "2": 2}
+	for speaker, want := range cases {
+		if got, err := resolveSpeaker(voice, speaker); err != nil || got != want {
+			t.Fatalf("%q: expected %d, got %d (%v)", speaker, want, got, err)
+		}
+	}
+	for _, speaker := range []string{"carol", "3", "-1"} {
+		if _, err := resolveSpeaker(voice, speaker); err == nil {
+			t.Fatalf("%q: expected error", speaker)
+		}
+	}
+	if _, err := resolveSpeaker(VoiceDetails{}, "0"); err != nil {
+		t.Fatalf("expected speaker 0 of a single speaker voice to be valid: %v", err)
 	}
 }
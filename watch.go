@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Delay between a change in VOICES_PATH and its rescan, so that the model
+// and config of a voice copied there are both complete.
+var voicesWatchSettleDelay = time.Second
+
+// watchVoicesPath keeps the registry in sync with VOICES_PATH, so voices
+// copied there or removed from it are picked up without a restart. Changes
+// are watched with inotify where available, and VOICES_PATH is polled every
+// VOICES_WATCH_INTERVAL_SECONDS otherwise.
+func watchVoicesPath(catalog *VoiceCatalog) {
+	if VOICES_WATCH_INTERVAL_SECONDS <= 0 {
+		return
+	}
+	var poll <-chan time.Time
+	changes, err := watchDirectory(VOICES_PATH)
+	if err != nil {
+		log.Printf("Failed to watch %s, polling it every %d seconds instead: %v", VOICES_PATH, VOICES_WATCH_INTERVAL_SECONDS, err)
+		poll = time.NewTicker(time.Duration(VOICES_WATCH_INTERVAL_SECONDS) * time.Second).C
+	}
+
+	go func() {
+		for {
+			select {
+			case _, ok := <-changes:
+				if !ok {
+					log.Printf("Stopped watching %s, polling it every %d seconds instead", VOICES_PATH, VOICES_WATCH_INTERVAL_SECONDS)
+					changes = nil
+					poll = time.NewTicker(time.Duration(VOICES_WATCH_INTERVAL_SECONDS) * time.Second).C
+					continue
+				}
+				time.Sleep(voicesWatchSettleDelay)
+				// Changes made while settling are covered by this rescan
+				select {
+				case <-changes:
+				default:
+				}
+			case <-poll:
+			}
+			syncVoicesPath(catalog)
+		}
+	}()
+}
+
+// syncVoicesPath registers the voices whose model and config both appeared in
+// VOICES_PATH and unregisters those whose files are gone. Voices that aren't
+// in the catalog are listed as custom voices. Uploads are waited for, so that
+// the files of a voice being uploaded aren't listed before the upload adds it.
+func syncVoicesPath(catalog *VoiceCatalog) {
+	customVoiceUploads.Lock()
+	defer customVoiceUploads.Unlock()
+
+	voiceNames, err := scanVoicesPath()
+	if err != nil {
+		log.Printf("Failed to scan %s: %v", VOICES_PATH, err)
+		return
+	}
+
+	for voiceName := range voiceNames {
+		if _, ok := voiceRegistry.get(voiceName); ok {
+			continue
+		}
+		details, err := parseVoiceDetails(voiceFilePath(voiceName + ".onnx.json"))
+		if err != nil {
+			log.Printf("Failed to get details of voice %s: %v", voiceName, err)
+			continue
+		}
+		voiceRegistry.set(voiceName, details)
+		log.Printf("Voice %s added to %s\n", voiceName, VOICES_PATH)
+	}
+
+	voices := catalog.get()
+	for _, voiceName := range voiceRegistry.names() {
+		if voiceNames[voiceName] {
+			continue
+		}
+		voiceRegistry.remove(voiceName)
+		if (*voices)[voiceName].Custom {
+			catalog.removeCustom(voiceName)
+		}
+		log.Printf("Voice %s removed from %s\n", voiceName, VOICES_PATH)
+	}
+
+	loadCustomVoices(catalog)
+}
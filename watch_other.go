@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// watchDirectory is only implemented with inotify, VOICES_PATH is polled on
+// other systems.
+func watchDirectory(dir string) (<-chan struct{}, error) {
+	return nil, errors.New("watching directories is not supported on this system")
+}
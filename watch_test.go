@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncVoicesPath_AddsAndRemovesVoices(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	catalog := newVoiceCatalog(Voices{"test-voice": {Key: "test-voice"}})
+	defer voiceRegistry.remove("test-voice")
+	defer voiceRegistry.remove("team-voice")
+
+	os.WriteFile(filepath.Join(dir, "test-voice.onnx"), []byte("model"), 0644)
+	os.WriteFile(filepath.Join(dir, "test-voice.onnx.json"), []byte(testVoiceConfig), 0644)
+	os.WriteFile(filepath.Join(dir, "team-voice.onnx"), []byte("model"), 0644)
+	os.WriteFile(filepath.Join(dir, "team-voice.onnx.json"), []byte(testCustomVoiceConfig), 0644)
+	// Incomplete pairs are ignored
+	os.WriteFile(filepath.Join(dir, "half-voice.onnx.json"), []byte(testVoiceConfig), 0644)
+
+	syncVoicesPath(catalog)
+	if details, ok := voiceRegistry.get("test-voice"); !ok || details.Audio.SampleRate != 16000 {
+		t.Fatalf("expected test-voice to be registered, got %+v", details)
+	}
+	if _, ok := voiceRegistry.get("half-voice"); ok {
+		t.Fatal("expected incomplete voice not to be registered")
+	}
+	if voice := (*catalog.get())["team-voice"]; !voice.Custom {
+		t.Fatal("expected voice missing from the catalog to be listed as custom")
+	}
+
+	os.Remove(filepath.Join(dir, "test-voice.onnx"))
+	os.Remove(filepath.Join(dir, "team-voice.onnx"))
+	syncVoicesPath(catalog)
+	if _, ok := voiceRegistry.get("test-voice"); ok {
+		t.Fatal("expected test-voice to be unregistered")
+	}
+	if _, ok := (*catalog.get())["team-voice"]; ok {
+		t.Fatal("expected custom voice to be removed from the catalog")
+	}
+	if _, ok := (*catalog.get())["test-voice"]; !ok {
+		t.Fatal("expected catalog voice to be kept")
+	}
+}
+
+func TestSyncVoicesPath_WaitsForUploads(t *testing.T) {
+	dir := useTempVoicesPath(t)
+	catalog := newVoiceCatalog(Voices{})
+	defer voiceRegistry.remove("team-voice")
+
+	customVoiceUploads.Lock()
+	// Files renamed into place by an upload that hasn't added the voice yet
+	os.WriteFile(filepath.Join(dir, "team-voice.onnx"), []byte("model"), 0644)
+	os.WriteFile(filepath.Join(dir, "team-voice.onnx.json"), []byte(testCustomVoiceConfig), 0644)
+	synced := make(chan struct{})
+	go func() {
+		syncVoicesPath(catalog)
+		close(synced)
+	}()
+
+	select {
+	case <-synced:
+		t.Fatal("expected the rescan to wait for the upload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok := (*catalog.get())["team-voice"]; ok {
+		t.Fatal("expected the voice not to be listed during the upload")
+	}
+	customVoiceUploads.Unlock()
+	<-synced
+}
+
+func TestWatchDirectory_ReportsChanges(t *testing.T) {
+	dir := t.TempDir()
+	changes, err := watchDirectory(dir)
+	if err != nil {
+		t.Skipf("watching directories is not supported: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "voice.onnx"), []byte("model"), 0644)
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a change to be reported")
+	}
+}
@@ -1,21 +1,65 @@
 package main
 
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+// WAV audio format codes
+const (
+	wavFormatPCM       = 1
+	wavFormatIEEEFloat = 3
+	wavFormatALaw      = 6
+	wavFormatMuLaw     = 7
+)
+
+// generatePCMWAVHeader writes the header of audio converted by convertPCM.
+func generatePCMWAVHeader(format pcmFormat) []byte {
+	audioFormat := wavFormatPCM
+	if format.BitsPerSample == 32 {
+		audioFormat = wavFormatIEEEFloat
+	}
+	return generateWAVFormatHeader(audioFormat, format.SampleRate, format.Channels, format.BitsPerSample)
+}
+
 // WAV header structure (44 bytes for standard PCM WAV)
 func generateWAVHeader(sampleRate, channels, bitsPerSample int) []byte {
-	header := make([]byte, 44)
+	return generateWAVFormatHeader(wavFormatPCM, sampleRate, channels, bitsPerSample)
+}
+
+// Header sizes written by generateWAVFormatHeader. Formats other than PCM
+// have an 18 byte fmt chunk and a fact chunk with their number of samples.
+const (
+	wavHeaderSize         = 44
+	wavExtendedHeaderSize = 58
+)
+
+// generateWAVFormatHeader writes the same header as generateWAVHeader for
+// another audio format, such as the 8 bit G.711 ones.
+func generateWAVFormatHeader(audioFormat, sampleRate, channels, bitsPerSample int) []byte {
+	size := wavHeaderSize
+	if audioFormat != wavFormatPCM {
+		size = wavExtendedHeaderSize
+	}
+	header := make([]byte, size)
 
 	// RIFF chunk
 	copy(header[0:4], []byte("RIFF"))
 	copy(header[4:8], []byte{0xFF, 0xFF, 0xFF, 0xFF}) // Size -1 for streaming
 	copy(header[8:12], []byte("WAVE"))
 	copy(header[12:16], []byte("fmt "))
-	// fmt chunk size (16 for PCM)
+	// fmt chunk size (16 for PCM, 18 with the cbSize of other formats)
 	header[16] = 16
+	if audioFormat != wavFormatPCM {
+		header[16] = 18
+	}
 	header[17] = 0
 	header[18] = 0
 	header[19] = 0
 	// Audio format (1 for PCM)
-	header[20] = 1
+	header[20] = byte(audioFormat)
 	header[21] = 0
 	// Number of channels
 	header[22] = byte(channels)
@@ -39,9 +83,331 @@ func generateWAVHeader(sampleRate, channels, bitsPerSample int) []byte {
 	header[34] = byte(bitsPerSample)
 	header[35] = byte(bitsPerSample >> 8)
 
+	if audioFormat != wavFormatPCM {
+		// cbSize (no extra format bytes), header[36:38] left at 0
+		// fact chunk with the number of samples per channel (unknown for streaming)
+		copy(header[38:42], []byte("fact"))
+		header[42] = 4
+		copy(header[46:50], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	}
+
 	// data chunk
-	copy(header[36:40], []byte("data"))
+	copy(header[size-8:size-4], []byte("data"))
 	// data size (unknown for streaming)
-	copy(header[40:44], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	copy(header[size-4:size], []byte{0xFF, 0xFF, 0xFF, 0xFF})
 	return header
 }
+
+// setWAVDataSize replaces the streaming sizes of header, written at the start
+// of w by generateWAVFormatHeader, once the size of the data chunk is known.
+func setWAVDataSize(w io.WriterAt, header []byte, dataSize int64) error {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(dataSize+int64(len(header))-8))
+	if _, err := w.WriteAt(size, 4); err != nil {
+		return err
+	}
+	if len(header) == wavExtendedHeaderSize {
+		blockAlign := int64(binary.LittleEndian.Uint16(header[32:34]))
+		binary.LittleEndian.PutUint32(size, uint32(dataSize/blockAlign))
+		if _, err := w.WriteAt(size, 46); err != nil {
+			return err
+		}
+	}
+	binary.LittleEndian.PutUint32(size, uint32(dataSize))
+	_, err := w.WriteAt(size, int64(len(header))-4)
+	return err
+}
+
+// Samples per FLAC frame, a common block size for 16 kHz to 48 kHz audio.
+const flacBlockSize = 4096
+
+// Size of the "fLaC" marker and STREAMINFO block written by newFLACEncoder.
+const flacHeaderSize = 42
+
+// flacEncoder encodes mono 16 bit little endian PCM to FLAC as it is
+// written, one frame per flacBlockSize samples. Subframes use whichever of
+// the constant, verbatim and fixed predictor encodings is the smallest.
+// Close writes the last, shorter frame.
+type flacEncoder struct {
+	w            io.Writer
+	sampleRate   int
+	pending      []byte
+	frameNumber  uint64
+	totalSamples uint64
+	md5          hash.Hash
+	err          error
+}
+
+// newFLACEncoder writes the FLAC stream header to w. Its STREAMINFO block
+// has an unknown length and MD5, see setFLACStreamInfo for seekable outputs.
+func newFLACEncoder(w io.Writer, sampleRate int) (*flacEncoder, error) {
+	header := append([]byte("fLaC"), 0x80, 0, 0, 34) // Last metadata block, STREAMINFO, 34 bytes
+	header = append(header, flacStreamInfo(sampleRate, 0, make([]byte, md5.Size))...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &flacEncoder{w: w, sampleRate: sampleRate, md5: md5.New()}, nil
+}
+
+func (e *flacEncoder) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	e.pending = append(e.pending, p...)
+	frameBytes := flacBlockSize * 2
+	for len(e.pending) >= frameBytes {
+		if e.err = e.writeFrame(e.pending[:frameBytes]); e.err != nil {
+			return 0, e.err
+		}
+		e.pending = e.pending[frameBytes:]
+	}
+	return len(p), nil
+}
+
+// Close encodes the remaining samples. A trailing odd byte is dropped.
+func (e *flacEncoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if len(e.pending) >= 2 {
+		e.err = e.writeFrame(e.pending[:len(e.pending)&^1])
+	}
+	e.pending = nil
+	return e.err
+}
+
+// streamInfo returns the STREAMINFO block of everything encoded so far.
+func (e *flacEncoder) streamInfo() []byte {
+	return flacStreamInfo(e.sampleRate, e.totalSamples, e.md5.Sum(nil))
+}
+
+// setFLACStreamInfo replaces the STREAMINFO block of a stream written by
+// newFLACEncoder once the encoder is closed, so players know its duration.
+func setFLACStreamInfo(w io.WriterAt, e *flacEncoder) error {
+	_, err := w.WriteAt(e.streamInfo(), 8)
+	return err
+}
+
+func flacStreamInfo(sampleRate int, totalSamples uint64, sum []byte) []byte {
+	var b flacBitWriter
+	b.write(flacBlockSize, 16) // Minimum block size
+	b.write(flacBlockSize, 16) // Maximum block size
+	b.write(0, 24)             // Minimum frame size, unknown
+	b.write(0, 24)             // Maximum frame size, unknown
+	b.write(uint64(sampleRate), 20)
+	b.write(0, 3)  // Channels - 1
+	b.write(15, 5) // Bits per sample - 1
+	b.write(totalSamples>>32, 4)
+	b.write(totalSamples&0xFFFFFFFF, 32)
+	return append(b.bytes(), sum...)
+}
+
+func (e *flacEncoder) writeFrame(pcm []byte) error {
+	e.md5.Write(pcm)
+	samples := make([]int32, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int32(int16(binary.LittleEndian.Uint16(pcm[2*i:])))
+	}
+
+	var b flacBitWriter
+	b.write(0xFFF8, 16) // Sync code, fixed block size
+	b.write(0x7, 4)     // Block size - 1 as 16 bits at the end of the header
+	if e.sampleRate <= 0xFFFF {
+		b.write(0xD, 4) // Sample rate in Hz as 16 bits at the end of the header
+	} else {
+		b.write(0x0, 4) // Sample rate from STREAMINFO
+	}
+	b.write(0x0, 4) // Mono
+	b.write(0x4, 3) // 16 bits per sample
+	b.write(0, 1)
+	for _, c := range flacUTF8(e.frameNumber) {
+		b.write(uint64(c), 8)
+	}
+	b.write(uint64(len(samples)-1), 16)
+	if e.sampleRate <= 0xFFFF {
+		b.write(uint64(e.sampleRate), 16)
+	}
+	b.write(uint64(flacCRC8(b.bytes())), 8)
+
+	writeFLACSubframe(&b, samples)
+	b.align()
+	b.write(uint64(flacCRC16(b.bytes())), 16)
+
+	if _, err := e.w.Write(b.bytes()); err != nil {
+		return err
+	}
+	e.frameNumber++
+	e.totalSamples += uint64(len(samples))
+	return nil
+}
+
+// Largest Rice parameter, 15 being the escape code.
+const flacMaxRiceParameter = 14
+
+func writeFLACSubframe(b *flacBitWriter, samples []int32) {
+	constant := true
+	for _, sample := range samples {
+		if sample != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		b.write(0x00, 8)
+		b.write(uint64(uint16(samples[0])), 16)
+		return
+	}
+
+	bestOrder, bestBits, bestParameter := -1, 16*len(samples), 0
+	var bestResiduals []int32
+	for order := 0; order <= 4 && order < len(samples); order++ {
+		residuals := flacFixedResiduals(samples, order)
+		parameter, bits := flacRiceParameter(residuals)
+		if bits += 16*order + 2 + 4 + 4; bits < bestBits {
+			bestOrder, bestBits, bestParameter, bestResiduals = order, bits, parameter, residuals
+		}
+	}
+
+	if bestOrder < 0 {
+		b.write(0x02, 8) // Verbatim
+		for _, sample := range samples {
+			b.write(uint64(uint16(sample)), 16)
+		}
+		return
+	}
+	b.write(uint64(0x08|bestOrder)<<1, 8) // Fixed predictor of bestOrder
+	for _, sample := range samples[:bestOrder] {
+		b.write(uint64(uint16(sample)), 16)
+	}
+	b.write(0, 2) // Rice coding with 4 bit parameters
+	b.write(0, 4) // A single partition
+	b.write(uint64(bestParameter), 4)
+	for _, residual := range bestResiduals {
+		u := uint64(uint32(residual<<1) ^ uint32(residual>>31))
+		b.writeUnary(u >> bestParameter)
+		b.write(u&(1<<bestParameter-1), uint(bestParameter))
+	}
+}
+
+// flacFixedResiduals returns the residuals of the fixed predictor of order.
+func flacFixedResiduals(samples []int32, order int) []int32 {
+	s := samples
+	residuals := make([]int32, len(s)-order)
+	for i := order; i < len(s); i++ {
+		var prediction int32
+		switch order {
+		case 1:
+			prediction = s[i-1]
+		case 2:
+			prediction = 2*s[i-1] - s[i-2]
+		case 3:
+			prediction = 3*s[i-1] - 3*s[i-2] + s[i-3]
+		case 4:
+			prediction = 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+		}
+		residuals[i-order] = s[i] - prediction
+	}
+	return residuals
+}
+
+// flacRiceParameter returns the Rice parameter encoding residuals in the
+// fewest bits, and that number of bits.
+func flacRiceParameter(residuals []int32) (int, int) {
+	bestParameter, bestBits := 0, -1
+	for parameter := 0; parameter <= flacMaxRiceParameter; parameter++ {
+		bits := len(residuals) * (parameter + 1)
+		for _, residual := range residuals {
+			bits += int((uint32(residual<<1) ^ uint32(residual>>31)) >> parameter)
+		}
+		if bestBits < 0 || bits < bestBits {
+			bestParameter, bestBits = parameter, bits
+		}
+	}
+	return bestParameter, bestBits
+}
+
+// flacUTF8 encodes a frame number the way UTF-8 encodes code points,
+// extended to 36 bits.
+func flacUTF8(value uint64) []byte {
+	if value < 0x80 {
+		return []byte{byte(value)}
+	}
+	n := 2
+	for value >= 1<<(5*n+1) {
+		n++
+	}
+	encoded := make([]byte, n)
+	for i := n - 1; i > 0; i-- {
+		encoded[i] = 0x80 | byte(value&0x3F)
+		value >>= 6
+	}
+	encoded[0] = byte(0xFF<<(8-n)) | byte(value)
+	return encoded
+}
+
+// flacBitWriter writes big endian bit fields.
+type flacBitWriter struct {
+	buf  []byte
+	acc  uint64
+	bits uint
+}
+
+// write appends the low n bits of value, n being at most 32.
+func (b *flacBitWriter) write(value uint64, n uint) {
+	b.acc = b.acc<<n | value&(1<<n-1)
+	b.bits += n
+	for b.bits >= 8 {
+		b.bits -= 8
+		b.buf = append(b.buf, byte(b.acc>>b.bits))
+	}
+}
+
+// writeUnary appends value zeros followed by a one.
+func (b *flacBitWriter) writeUnary(value uint64) {
+	for ; value >= 32; value -= 32 {
+		b.write(0, 32)
+	}
+	b.write(1, uint(value)+1)
+}
+
+// align pads the last byte with zeros.
+func (b *flacBitWriter) align() {
+	if b.bits > 0 {
+		b.write(0, 8-b.bits)
+	}
+}
+
+// bytes returns the complete bytes written so far.
+func (b *flacBitWriter) bytes() []byte {
+	return b.buf
+}
+
+func flacCRC8(data []byte) byte {
+	var crc byte
+	for _, c := range data {
+		crc ^= c
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func flacCRC16(data []byte) uint16 {
+	var crc uint16
+	for _, c := range data {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -58,6 +65,82 @@ func TestGenerateWAVHeader_AudioFormat(t *testing.T) {
 	}
 }
 
+func TestGenerateWAVFormatHeader_MuLaw(t *testing.T) {
+	h := generateWAVFormatHeader(wavFormatMuLaw, 8000, 1, 8)
+	if format := binary.LittleEndian.Uint16(h[20:22]); format != 7 {
+		t.Fatalf("expected audio format 7 (mu-law), got %d", format)
+	}
+	if byteRate := binary.LittleEndian.Uint32(h[28:32]); byteRate != 8000 {
+		t.Fatalf("expected byte rate 8000, got %d", byteRate)
+	}
+	if blockAlign := binary.LittleEndian.Uint16(h[32:34]); blockAlign != 1 {
+		t.Fatalf("expected block align 1, got %d", blockAlign)
+	}
+	if len(h) != 58 {
+		t.Fatalf("expected 58 bytes, got %d", len(h))
+	}
+	if fmtSize := binary.LittleEndian.Uint32(h[16:20]); fmtSize != 18 {
+		t.Fatalf("expected fmt chunk size 18, got %d", fmtSize)
+	}
+	if cbSize := binary.LittleEndian.Uint16(h[36:38]); cbSize != 0 {
+		t.Fatalf("expected cbSize 0, got %d", cbSize)
+	}
+	if string(h[38:42]) != "fact" || binary.LittleEndian.Uint32(h[42:46]) != 4 {
+		t.Fatalf("expected a 4 byte fact chunk, got %x", h[38:46])
+	}
+	if string(h[50:54]) != "data" {
+		t.Fatalf("expected 'data', got %q", h[50:54])
+	}
+}
+
+func TestSetWAVDataSize(t *testing.T) {
+	for _, tc := range []struct {
+		header     []byte
+		dataOffset int
+	}{
+		{generateWAVHeader(22050, 1, 16), 40},
+		{generatePCMWAVHeader(pcmFormat{SampleRate: 48000, Channels: 2, BitsPerSample: 32}), 54},
+	} {
+		file, err := os.Create(filepath.Join(t.TempDir(), "audio.wav"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(tc.header)
+		file.Write(make([]byte, 800))
+		if err := setWAVDataSize(file, tc.header, 800); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		file.Close()
+		data, _ := os.ReadFile(file.Name())
+
+		if size := binary.LittleEndian.Uint32(data[4:8]); size != uint32(len(data)-8) {
+			t.Fatalf("expected RIFF size %d, got %d", len(data)-8, size)
+		}
+		if size := binary.LittleEndian.Uint32(data[tc.dataOffset:]); size != 800 {
+			t.Fatalf("expected data size 800 at %d, got %d", tc.dataOffset, size)
+		}
+		if tc.dataOffset == 54 {
+			// 100 stereo float samples
+			if samples := binary.LittleEndian.Uint32(data[46:50]); samples != 100 {
+				t.Fatalf("expected 100 samples in the fact chunk, got %d", samples)
+			}
+		}
+	}
+}
+
+func TestGeneratePCMWAVHeader_Float(t *testing.T) {
+	h := generatePCMWAVHeader(pcmFormat{SampleRate: 48000, Channels: 2, BitsPerSample: 32})
+	if format := binary.LittleEndian.Uint16(h[20:22]); format != 3 {
+		t.Fatalf("expected audio format 3 (IEEE float), got %d", format)
+	}
+	if byteRate := binary.LittleEndian.Uint32(h[28:32]); byteRate != 48000*2*4 {
+		t.Fatalf("expected byte rate %d, got %d", 48000*2*4, byteRate)
+	}
+	if blockAlign := binary.LittleEndian.Uint16(h[32:34]); blockAlign != 8 {
+		t.Fatalf("expected block align 8, got %d", blockAlign)
+	}
+}
+
 func TestGenerateWAVHeader_Channels(t *testing.T) {
 	h := generateWAVHeader(22050, 2, 16)
 	if h[22] != 2 {
@@ -117,3 +200,290 @@ func TestGenerateWAVHeader_DataChunkSize(t *testing.T) {
 		}
 	}
 }
+
+// flacBitReader reads the big endian bit fields of a FLAC stream.
+type flacBitReader struct {
+	data []byte
+	pos  int // In bits
+}
+
+func (r *flacBitReader) read(n int) (uint64, error) {
+	var value uint64
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			return 0, errors.New("unexpected end of stream")
+		}
+		bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+		value = value<<1 | uint64(bit)
+		r.pos++
+	}
+	return value, nil
+}
+
+func (r *flacBitReader) readSigned(n int) (int32, error) {
+	value, err := r.read(n)
+	return int32(value<<(64-n)>>(64-n)) | -int32(value>>(n-1)&1)<<(n-1), err
+}
+
+func (r *flacBitReader) readUnary() (uint64, error) {
+	var zeros uint64
+	for {
+		bit, err := r.read(1)
+		if err != nil || bit == 1 {
+			return zeros, err
+		}
+		zeros++
+	}
+}
+
+// decodeTestFLAC decodes the mono 16 bit streams written by flacEncoder,
+// checking their CRCs. It returns the samples and the STREAMINFO sample rate,
+// total samples and MD5.
+func decodeTestFLAC(data []byte) ([]int16, int, uint64, []byte, error) {
+	if !bytes.HasPrefix(data, []byte("fLaC")) {
+		return nil, 0, 0, nil, errors.New("missing fLaC marker")
+	}
+	r := &flacBitReader{data: data, pos: 32}
+	var sampleRate int
+	var totalSamples uint64
+	var sum []byte
+	for last := uint64(0); last == 0; {
+		last, _ = r.read(1)
+		blockType, _ := r.read(7)
+		length, _ := r.read(24)
+		start := r.pos / 8
+		if blockType == 0 {
+			r.read(16 + 16 + 24 + 24)
+			rate, _ := r.read(20)
+			sampleRate = int(rate)
+			r.read(3 + 5)
+			totalSamples, _ = r.read(36)
+			sum = data[start+18 : start+34]
+		}
+		r.pos = (start + int(length)) * 8
+	}
+
+	var samples []int16
+	for r.pos/8 < len(data) {
+		frameStart := r.pos / 8
+		if sync, _ := r.read(16); sync != 0xFFF8 {
+			return nil, 0, 0, nil, fmt.Errorf("bad frame sync %x", sync)
+		}
+		blockSizeCode, _ := r.read(4)
+		rateCode, _ := r.read(4)
+		channels, _ := r.read(4)
+		sampleSize, _ := r.read(3)
+		r.read(1)
+		if channels != 0 || sampleSize != 4 || blockSizeCode != 7 {
+			return nil, 0, 0, nil, fmt.Errorf("unexpected frame header %d %d %d", blockSizeCode, channels, sampleSize)
+		}
+		first, _ := r.read(8)
+		for mask := uint64(0x80); first&mask != 0 && mask != 0x40; mask >>= 1 {
+			r.read(8)
+		}
+		blockSize, _ := r.read(16)
+		blockSize++
+		if rateCode == 0xD {
+			r.read(16)
+		}
+		if crc, _ := r.read(8); byte(crc) != flacCRC8(data[frameStart:r.pos/8-1]) {
+			return nil, 0, 0, nil, errors.New("bad frame header CRC")
+		}
+
+		r.read(1)
+		subframeType, _ := r.read(6)
+		r.read(1)
+		block := make([]int32, blockSize)
+		switch {
+		case subframeType == 0:
+			value, _ := r.readSigned(16)
+			for i := range block {
+				block[i] = value
+			}
+		case subframeType == 1:
+			for i := range block {
+				block[i], _ = r.readSigned(16)
+			}
+		case subframeType&0x38 == 0x08:
+			order := int(subframeType & 7)
+			for i := 0; i < order; i++ {
+				block[i], _ = r.readSigned(16)
+			}
+			if method, _ := r.read(2); method != 0 {
+				return nil, 0, 0, nil, errors.New("unexpected residual coding method")
+			}
+			partitionOrder, _ := r.read(4)
+			partitions := 1 << partitionOrder
+			i := order
+			for p := 0; p < partitions; p++ {
+				parameter, _ := r.read(4)
+				count := int(blockSize) / partitions
+				if p == 0 {
+					count -= order
+				}
+				for j := 0; j < count; j++ {
+					q, _ := r.readUnary()
+					low, _ := r.read(int(parameter))
+					u := q<<parameter | low
+					residual := int32(u>>1) ^ -int32(u&1)
+					s := block
+					var prediction int32
+					switch order {
+					case 1:
+						prediction = s[i-1]
+					case 2:
+						prediction = 2*s[i-1] - s[i-2]
+					case 3:
+						prediction = 3*s[i-1] - 3*s[i-2] + s[i-3]
+					case 4:
+						prediction = 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+					}
+					block[i] = prediction + residual
+					i++
+				}
+			}
+		default:
+			return nil, 0, 0, nil, fmt.Errorf("unexpected subframe type %d", subframeType)
+		}
+		if r.pos%8 != 0 {
+			r.read(8 - r.pos%8)
+		}
+		if crc, _ := r.read(16); uint16(crc) != flacCRC16(data[frameStart:r.pos/8-2]) {
+			return nil, 0, 0, nil, errors.New("bad frame CRC")
+		}
+		for _, sample := range block {
+			samples = append(samples, int16(sample))
+		}
+	}
+	return samples, sampleRate, totalSamples, sum, nil
+}
+
+func testFLACSamples(n int) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		switch {
+		case i < 1000:
+			// Silence, encoded as a constant subframe
+		case i < 6000:
+			samples[i] = int16(12000 * math.Sin(float64(i)/7))
+		default:
+			// Noise, encoded verbatim
+			samples[i] = int16(uint32(i) * 2654435761 >> 16)
+		}
+	}
+	samples[n-1] = math.MinInt16
+	samples[n-2] = math.MaxInt16
+	return samples
+}
+
+func pcmBytes(samples []int16) []byte {
+	pcm := make([]byte, 2*len(samples))
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(sample))
+	}
+	return pcm
+}
+
+func TestFLACEncoder_DecodesToIdenticalSamples(t *testing.T) {
+	samples := testFLACSamples(3*flacBlockSize + 123)
+	pcm := pcmBytes(samples)
+
+	var out bytes.Buffer
+	e, err := newFLACEncoder(&out, 22050)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd sized writes, as piper's output is read
+	for len(pcm) > 0 {
+		n := min(len(pcm), 1001)
+		if _, err := e.Write(pcm[:n]); err != nil {
+			t.Fatal(err)
+		}
+		pcm = pcm[n:]
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() >= 2*len(samples) {
+		t.Fatalf("expected FLAC to be smaller than the PCM, got %d bytes", out.Len())
+	}
+
+	decoded, sampleRate, _, _, err := decodeTestFLAC(out.Bytes())
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if sampleRate != 22050 {
+		t.Fatalf("expected sample rate 22050, got %d", sampleRate)
+	}
+	if len(decoded) != len(samples) {
+		t.Fatalf("expected %d samples, got %d", len(samples), len(decoded))
+	}
+	for i := range samples {
+		if decoded[i] != samples[i] {
+			t.Fatalf("sample %d: expected %d, got %d", i, samples[i], decoded[i])
+		}
+	}
+}
+
+func TestFLACEncoder_EmptyStream(t *testing.T) {
+	var out bytes.Buffer
+	e, _ := newFLACEncoder(&out, 16000)
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != flacHeaderSize {
+		t.Fatalf("expected only the %d byte header, got %d bytes", flacHeaderSize, out.Len())
+	}
+}
+
+func TestSetFLACStreamInfo(t *testing.T) {
+	samples := testFLACSamples(5000)
+	file, err := os.Create(filepath.Join(t.TempDir(), "audio.flac"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	e, _ := newFLACEncoder(file, 16000)
+	e.Write(pcmBytes(samples))
+	e.Close()
+	if err := setFLACStreamInfo(file, e); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(file.Name())
+	decoded, _, totalSamples, sum, err := decodeTestFLAC(data)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if totalSamples != uint64(len(samples)) || len(decoded) != len(samples) {
+		t.Fatalf("expected %d samples, got %d in STREAMINFO", len(samples), totalSamples)
+	}
+	expected := md5.Sum(pcmBytes(samples))
+	if !bytes.Equal(sum, expected[:]) {
+		t.Fatalf("unexpected MD5 %x", sum)
+	}
+}
+
+func TestFLACCRCs(t *testing.T) {
+	if crc := flacCRC8([]byte("123456789")); crc != 0xF4 {
+		t.Fatalf("expected CRC-8 0xF4, got 0x%02X", crc)
+	}
+	if crc := flacCRC16([]byte("123456789")); crc != 0xFEE8 {
+		t.Fatalf("expected CRC-16 0xFEE8, got 0x%04X", crc)
+	}
+}
+
+func TestFLACUTF8(t *testing.T) {
+	cases := map[uint64][]byte{
+		0x7F:   {0x7F},
+		0x80:   {0xC2, 0x80},
+		0x7FF:  {0xDF, 0xBF},
+		0x800:  {0xE0, 0xA0, 0x80},
+		0x1000: {0xE1, 0x80, 0x80},
+	}
+	for value, want := range cases {
+		if got := flacUTF8(value); !bytes.Equal(got, want) {
+			t.Fatalf("%x: expected %x, got %x", value, want, got)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Wyoming is the JSONL + binary payload protocol Home Assistant uses to talk
+// to voice services: https://github.com/rhasspy/wyoming
+
+const wyomingVersion = "1.5.4"
+
+// Samples per audio-chunk event, piper outputs 16 bit mono audio.
+const wyomingSamplesPerChunk = 1024
+
+type wyomingEvent struct {
+	Type          string          `json:"type"`
+	Version       string          `json:"version,omitempty"`
+	Data          json.RawMessage `json:"data,omitempty"`
+	DataLength    int             `json:"data_length,omitempty"`
+	PayloadLength int             `json:"payload_length,omitempty"`
+	Payload       []byte          `json:"-"`
+}
+
+type wyomingAttribution struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type wyomingSpeaker struct {
+	Name string `json:"name"`
+}
+
+type wyomingVoice struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Attribution wyomingAttribution `json:"attribution"`
+	Installed   bool               `json:"installed"`
+	Version     *string            `json:"version"`
+	Languages   []string           `json:"languages"`
+	Speakers    []wyomingSpeaker   `json:"speakers,omitempty"`
+}
+
+type wyomingTTSProgram struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Attribution wyomingAttribution `json:"attribution"`
+	Installed   bool               `json:"installed"`
+	Version     *string            `json:"version"`
+	Voices      []wyomingVoice     `json:"voices"`
+}
+
+type wyomingSynthesize struct {
+	Text  string `json:"text"`
+	Voice *struct {
+		Name     string `json:"name"`
+		Language string `json:"language"`
+		Speaker  string `json:"speaker"`
+	} `json:"voice"`
+}
+
+var piperAttribution = wyomingAttribution{Name: "rhasspy", URL: "https://github.com/rhasspy/piper"}
+
+func readWyomingEvent(r *bufio.Reader) (wyomingEvent, error) {
+	var event wyomingEvent
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return event, err
+	}
+	if err := json.Unmarshal(line, &event); err != nil {
+		return event, fmt.Errorf("invalid wyoming event header: %v", err)
+	}
+	if event.DataLength > 0 {
+		data := make([]byte, event.DataLength)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return event, err
+		}
+		event.Data = data
+	}
+	if event.PayloadLength > 0 {
+		event.Payload = make([]byte, event.PayloadLength)
+		if _, err := io.ReadFull(r, event.Payload); err != nil {
+			return event, err
+		}
+	}
+	return event, nil
+}
+
+func writeWyomingEvent(w io.Writer, eventType string, data interface{}, payload []byte) error {
+	event := wyomingEvent{Type: eventType, Version: wyomingVersion, PayloadLength: len(payload)}
+	var dataBytes []byte
+	if data != nil {
+		var err error
+		if dataBytes, err = json.Marshal(data); err != nil {
+			return err
+		}
+		event.DataLength = len(dataBytes)
+	}
+	header, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, len(header)+1+len(dataBytes)+len(payload))
+	buf = append(buf, header...)
+	buf = append(buf, '\n')
+	buf = append(buf, dataBytes...)
+	buf = append(buf, payload...)
+	_, err = w.Write(buf)
+	return err
+}
+
+func buildWyomingInfo(voices *Voices) map[string]interface{} {
+	wyomingVoices := make([]wyomingVoice, 0, len(*voices))
+	for key, voice := range *voices {
+		_, installed := voiceRegistry.get(key)
+		v := wyomingVoice{
+			Name:        key,
+			Description: fmt.Sprintf("%s (%s)", voice.Name, voice.Quality),
+			Attribution: piperAttribution,
+			Installed:   installed,
+			Languages:   []string{voice.Language.Code},
+		}
+		if voice.NumSpeakers > 1 {
+			for speaker := range voice.SpeakerIDMap {
+				v.Speakers = append(v.Speakers, wyomingSpeaker{Name: speaker})
+			}
+			sort.Slice(v.Speakers, func(i, j int) bool { return v.Speakers[i].Name < v.Speakers[j].Name })
+		}
+		wyomingVoices = append(wyomingVoices, v)
+	}
+	sort.Slice(wyomingVoices, func(i, j int) bool { return wyomingVoices[i].Name < wyomingVoices[j].Name })
+
+	return map[string]interface{}{
+		"tts": []wyomingTTSProgram{{
+			Name:        "piper",
+			Description: "A fast, local, neural text to speech engine",
+			Attribution: piperAttribution,
+			Installed:   true,
+			Voices:      wyomingVoices,
+		}},
+	}
+}
+
+// resolveWyomingVoice picks the voice for a synthesize event: the requested
+// name, else the first installed voice for the requested language, else the
+// default voice.
+func resolveWyomingVoice(voices *Voices, request wyomingSynthesize) string {
+	if request.Voice == nil {
+		return DEFAULT_VOICE
+	}
+	if request.Voice.Name != "" {
+		return request.Voice.Name
+	}
+	if request.Voice.Language != "" {
+		var candidates []string
+		for _, key := range voiceRegistry.names() {
+			if voice, ok := (*voices)[key]; ok && strings.EqualFold(voice.Language.Code, request.Voice.Language) {
+				candidates = append(candidates, key)
+			}
+		}
+		if len(candidates) > 0 {
+			sort.Strings(candidates)
+			return candidates[0]
+		}
+	}
+	return DEFAULT_VOICE
+}
+
+func wyomingSynthesizeEvent(w io.Writer, voices *Voices, pool *PiperPool, data json.RawMessage) error {
+	var request wyomingSynthesize
+	if err := json.Unmarshal(data, &request); err != nil {
+		return fmt.Errorf("invalid synthesize event: %v", err)
+	}
+	if request.Text == "" {
+		return errors.New("text is required")
+	}
+
+	voiceName, err := resolveVoiceName(voices, resolveWyomingVoice(voices, request))
+	if err != nil {
+		return err
+	}
+	voice, err := getVoiceDetails(voices, voiceName)
+	if err != nil {
+		return fmt.Errorf("voice not found: %s", voiceName)
+	}
+	speaker := 0
+	if request.Voice != nil {
+		if speaker, err = resolveSpeaker(voice, request.Voice.Speaker); err != nil {
+			return err
+		}
+	}
+	if logInput {
+		log.Printf("wyoming synthesize: %q", request.Text)
+	}
+
+	segment := ttsSegment{
+		Config:   applyInferenceDefaults(piperConfig{Voice: voiceName, Speaker: speaker, LengthScale: 1.0}, inferenceParameters{}, voice),
+		Text:     request.Text,
+		Language: (*voices)[voiceName].Language.Code,
+	}
+	audio := newSegmentStream(context.Background(), pool, []ttsSegment{segment}, voice.Audio.SampleRate)
+	defer audio.Close()
+
+	format := map[string]int{"rate": voice.Audio.SampleRate, "width": 2, "channels": 1}
+	if err := writeWyomingEvent(w, "audio-start", format, nil); err != nil {
+		return err
+	}
+	buffer := make([]byte, wyomingSamplesPerChunk*2)
+	for {
+		n, err := io.ReadFull(audio, buffer)
+		if n > 0 {
+			if err := writeWyomingEvent(w, "audio-chunk", format, buffer[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writeWyomingEvent(w, "audio-stop", map[string]interface{}{}, nil)
+}
+
+func handleWyomingConn(conn net.Conn, catalog *VoiceCatalog, pool *PiperPool) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		event, err := readWyomingEvent(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("wyoming: error reading event from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		voices := catalog.get()
+		switch event.Type {
+		case "describe":
+			err = writeWyomingEvent(conn, "info", buildWyomingInfo(voices), nil)
+		case "synthesize":
+			if synthErr := wyomingSynthesizeEvent(conn, voices, pool, event.Data); synthErr != nil {
+				log.Printf("wyoming: synthesize failed: %v", synthErr)
+				err = writeWyomingEvent(conn, "error", map[string]string{"text": synthErr.Error(), "code": "synthesize-failed"}, nil)
+			}
+		default:
+			log.Printf("wyoming: ignoring unsupported event %q", event.Type)
+		}
+		if err != nil {
+			log.Printf("wyoming: error writing to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func serveWyoming(listener net.Listener, catalog *VoiceCatalog, pool *PiperPool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("wyoming: accept failed: %v", err)
+			}
+			return
+		}
+		go handleWyomingConn(conn, catalog, pool)
+	}
+}
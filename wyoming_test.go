@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWyomingEvent_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	data := map[string]int{"rate": 22050, "width": 2, "channels": 1}
+	if err := writeWyomingEvent(&buf, "audio-chunk", data, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	event, err := readWyomingEvent(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event.Type != "audio-chunk" {
+		t.Fatalf("expected type 'audio-chunk', got %q", event.Type)
+	}
+	var decoded map[string]int
+	if err := json.Unmarshal(event.Data, &decoded); err != nil {
+		t.Fatalf("invalid event data: %v", err)
+	}
+	if decoded["rate"] != 22050 {
+		t.Fatalf("expected rate 22050, got %v", decoded)
+	}
+	if !bytes.Equal(event.Payload, []byte{1, 2, 3, 4}) {
+		t.Fatalf("unexpected payload %v", event.Payload)
+	}
+}
+
+func TestReadWyomingEvent_InlineData(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString(`{"type":"synthesize","data":{"text":"hello"}}` + "\n"))
+	event, err := readWyomingEvent(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var request wyomingSynthesize
+	if err := json.Unmarshal(event.Data, &request); err != nil {
+		t.Fatalf("invalid event data: %v", err)
+	}
+	if request.Text != "hello" {
+		t.Fatalf("expected text 'hello', got %q", request.Text)
+	}
+}
+
+func TestBuildWyomingInfo_InstalledFlag(t *testing.T) {
+	voices := Voices{
+		"test-wyoming-installed": Voice{Name: "amy", Quality: "low", Language: Language{Code: "en_US"}},
+		"test-wyoming-missing":   Voice{Name: "alan", Quality: "low", Language: Language{Code: "en_GB"}},
+	}
+	voiceRegistry.set("test-wyoming-installed", VoiceDetails{})
+	defer voiceRegistry.remove("test-wyoming-installed")
+
+	info := buildWyomingInfo(&voices)
+	programs := info["tts"].([]wyomingTTSProgram)
+	if len(programs) != 1 || len(programs[0].Voices) != 2 {
+		t.Fatalf("expected one program with 2 voices, got %+v", programs)
+	}
+	for _, v := range programs[0].Voices {
+		if want := v.Name == "test-wyoming-installed"; v.Installed != want {
+			t.Fatalf("voice %s: expected installed=%v", v.Name, want)
+		}
+	}
+}
+
+func TestResolveWyomingVoice_ByLanguage(t *testing.T) {
+	voices := Voices{"test-wyoming-fr": Voice{Language: Language{Code: "fr_FR"}}}
+	voiceRegistry.set("test-wyoming-fr", VoiceDetails{})
+	defer voiceRegistry.remove("test-wyoming-fr")
+
+	var request wyomingSynthesize
+	json.Unmarshal([]byte(`{"text":"bonjour","voice":{"language":"fr_FR"}}`), &request)
+	if got := resolveWyomingVoice(&voices, request); got != "test-wyoming-fr" {
+		t.Fatalf("expected 'test-wyoming-fr', got %q", got)
+	}
+}
+
+func TestResolveWyomingVoice_Default(t *testing.T) {
+	voices := Voices{}
+	if got := resolveWyomingVoice(&voices, wyomingSynthesize{Text: "hello"}); got != DEFAULT_VOICE {
+		t.Fatalf("expected default voice, got %q", got)
+	}
+}
+
+func TestHandleWyomingConn_Synthesize(t *testing.T) {
+	useFakePiper(t)
+	pool := newPiperPool(0, 1, 1, time.Minute)
+	defer pool.close()
+	voices := Voices{}
+	voiceRegistry.set("test-wyoming-voice", VoiceDetails{Audio: VoiceDetailsAudio{SampleRate: 16000}})
+	defer voiceRegistry.remove("test-wyoming-voice")
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go handleWyomingConn(server, newVoiceCatalog(voices), pool)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := map[string]interface{}{"text": "hello", "voice": map[string]string{"name": "test-wyoming-voice"}}
+	if err := writeWyomingEvent(client, "synthesize", request, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reader := bufio.NewReader(client)
+	var types []string
+	var audio []byte
+	for {
+		event, err := readWyomingEvent(reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		types = append(types, event.Type)
+		audio = append(audio, event.Payload...)
+		if event.Type == "audio-start" {
+			var format map[string]int
+			json.Unmarshal(event.Data, &format)
+			if format["rate"] != 16000 {
+				t.Fatalf("expected rate 16000, got %v", format)
+			}
+		}
+		if event.Type == "audio-stop" || event.Type == "error" {
+			break
+		}
+	}
+	if types[0] != "audio-start" || types[len(types)-1] != "audio-stop" {
+		t.Fatalf("unexpected event sequence %v", types)
+	}
+	if string(audio) != `audio:{"text":"hello"}` {
+		t.Fatalf("unexpected audio payload %q", audio)
+	}
+}